@@ -3,14 +3,20 @@ package main
 import (
 	"bufio"
 	"encoding/binary"
+	"errors"
 	"flag"
 	"fmt"
+	"io/fs"
 	"log"
 	"math"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"slices"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/Div9851/gba-go/pkg/emulator"
@@ -28,11 +34,44 @@ const (
 )
 
 type Game struct {
-	emulator *emulator.GBA
-	keys     []ebiten.Key
+	emulator  *emulator.GBA
+	keys      []ebiten.Key
+	statePath string
+	quit      atomic.Bool
+}
+
+func (g *Game) saveState() {
+	if err := g.emulator.SaveStateFile(g.statePath); err != nil {
+		log.Printf("save state: %v", err)
+		return
+	}
+	log.Printf("saved state to %s", g.statePath)
+}
+
+func (g *Game) loadState() {
+	f, err := os.Open(g.statePath)
+	if err != nil {
+		log.Printf("load state: %v", err)
+		return
+	}
+	defer f.Close()
+	if err := g.emulator.LoadState(bufio.NewReader(f)); err != nil {
+		log.Printf("load state: %v", err)
+		return
+	}
+	log.Printf("loaded state from %s", g.statePath)
 }
 
 func (g *Game) Update() error {
+	if g.quit.Load() {
+		return ebiten.Termination
+	}
+	if inpututil.IsKeyJustPressed(ebiten.KeyF5) {
+		g.saveState()
+	}
+	if inpututil.IsKeyJustPressed(ebiten.KeyF9) {
+		g.loadState()
+	}
 	g.keys = inpututil.AppendPressedKeys(g.keys[:0])
 	var keys []string
 	for _, key := range g.keys {
@@ -50,31 +89,47 @@ func (g *Game) Layout(outsideWidth, outsideHeight int) (int, int) {
 	return screenWidth, screenHeight
 }
 
+type FrameReader interface {
+	ReadFrames(frames [][2]float32) int
+}
+
+// Streamer pulls the APU output for the audio player as interleaved
+// little-endian float32 frames. It plays silence while the APU has none.
 type Streamer struct {
-	ch chan float32
+	source FrameReader
+	frames [][2]float32
 }
 
-func NewStreamer(ch chan float32) *Streamer {
+func NewStreamer(source FrameReader) *Streamer {
 	return &Streamer{
-		ch: ch,
+		source: source,
 	}
 }
 
 func (s *Streamer) Read(p []byte) (n int, err error) {
-	for n = 0; n+4 <= len(p); n += 4 {
-		select {
-		case sample := <-s.ch:
-			binary.LittleEndian.PutUint32(p[n:], math.Float32bits(sample))
-		default:
-		}
+	count := len(p) / 8
+	if len(s.frames) < count {
+		s.frames = make([][2]float32, count)
 	}
-	return
+	frames := s.frames[:count]
+	clear(frames[s.source.ReadFrames(frames):])
+	for i, frame := range frames {
+		binary.LittleEndian.PutUint32(p[8*i:], math.Float32bits(frame[0]))
+		binary.LittleEndian.PutUint32(p[8*i+4:], math.Float32bits(frame[1]))
+	}
+	return count * 8, nil
 }
 
 func main() {
 	var (
 		biosFilePath = flag.String("bios", "assets/bios.bin", "BIOS file path")
 		romFilePath  = flag.String("rom", "assets/hello.gba", "ROM file path")
+		savePath     = flag.String("save", "", "battery save file path (default: ROM path with .sav)")
+		saveType     = flag.String("savetype", "auto", "backup type: auto, none, sram, eeprom, eeprom512, eeprom8k, flash64k, flash128k, flash64k-atmel, flash64k-macronix, flash128k-macronix")
+		statePath    = flag.String("state", "", "save state file path (F5: save, F9: load)")
+		rtcOffset    = flag.Duration("rtcoffset", 0, "cartridge clock offset from the host clock (e.g. -9h)")
+		bootMode     = flag.String("boot", "direct", "boot mode: direct, bios")
+		sampleRate   = flag.Int("samplerate", 48000, "audio output sample rate in Hz")
 		debug        = flag.Bool("debug", false, "debug mode")
 	)
 
@@ -83,16 +138,36 @@ func main() {
 	gba := emulator.NewGBA()
 
 	biosData, err := os.ReadFile(*biosFilePath)
-	if err != nil {
+	if errors.Is(err, fs.ErrNotExist) {
+		log.Printf("%s not found, using HLE BIOS", *biosFilePath)
+		gba.UseHLEBIOS()
+	} else if err != nil {
 		panic(err)
+	} else {
+		gba.LoadBIOS(biosData)
+	}
+
+	if *savePath == "" {
+		*savePath = strings.TrimSuffix(*romFilePath, filepath.Ext(*romFilePath)) + ".sav"
+	}
+	gba.SavePath = *savePath
+	gba.SaveType, err = emulator.ParseSaveType(*saveType)
+	if err != nil {
+		log.Fatal(err)
+	}
+	gba.RTCOffset = *rtcOffset
+	gba.BootMode, err = emulator.ParseBootMode(*bootMode)
+	if err != nil {
+		log.Fatal(err)
 	}
-	gba.LoadBIOS(biosData)
 
 	romData, err := os.ReadFile(*romFilePath)
 	if err != nil {
 		panic(err)
 	}
-	gba.LoadROM(romData)
+	if err := gba.LoadROM(romData); err != nil {
+		panic(err)
+	}
 
 	gba.Start()
 
@@ -147,22 +222,37 @@ func main() {
 		}
 	}
 
-	ch := make(chan float32, 10000)
-	streamer := NewStreamer(ch)
-	gba.APU.StreamerCh = ch
+	gba.APU.SetSampleRate(*sampleRate)
+	streamer := NewStreamer(gba.APU)
 
-	audioContext := audio.NewContext(32768)
+	audioContext := audio.NewContext(*sampleRate)
 	audioPlayer, _ := audioContext.NewPlayerF32(streamer)
 	audioPlayer.SetBufferSize(time.Millisecond * 60)
 	audioPlayer.Play()
 
+	if *statePath == "" {
+		*statePath = strings.TrimSuffix(*romFilePath, filepath.Ext(*romFilePath)) + ".state"
+	}
+
 	game := &Game{
-		emulator: gba,
+		emulator:  gba,
+		statePath: *statePath,
 	}
 
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigCh
+		game.quit.Store(true)
+	}()
+
 	ebiten.SetWindowSize(screenWidth*scaleFactor, screenHeight*scaleFactor)
 	ebiten.SetWindowTitle("GBA Emulator")
-	if err := ebiten.RunGame(game); err != nil {
-		log.Fatal(err)
+	runErr := ebiten.RunGame(game)
+	if err := gba.FlushSave(); err != nil {
+		log.Printf("save: %v", err)
+	}
+	if runErr != nil {
+		log.Fatal(runErr)
 	}
 }
@@ -2,10 +2,21 @@ package apu
 
 import (
 	"github.com/Div9851/gba-go/internal/dma"
+	"github.com/Div9851/gba-go/internal/scheduler"
+	"github.com/Div9851/gba-go/internal/state"
 )
 
 const (
 	systemClock = 16 * 1024 * 1024
+	// system clock 16*1024*1024 ≒ 16.78 MHz
+	// sampling rate is 32.768 KHz (system clock / 512)
+	cyclesPerSample = 512
+	// Output rate used until SetSampleRate is called
+	defaultSampleRate = 32768
+	// The frame sequencer runs at 512 Hz and clocks the length counters
+	// on even steps (256 Hz), the sweep on steps 2 and 6 (128 Hz) and the
+	// envelopes on step 7 (64 Hz).
+	cyclesPerFrameStep = systemClock / 512
 )
 
 var waveDuty = [4][8]bool{
@@ -15,94 +26,197 @@ var waveDuty = [4][8]bool{
 	{true, false, false, true, true, true, true, true},      // 75%
 }
 
+// Noise clock divisors for SOUND4CNT_H bits 0-2, in cycles. The frequency
+// is 524288 Hz / r / 2^(s+1), with r=0 counting as 0.5 and s in bits 4-7.
+var noiseDivisors = [8]int{32, 64, 128, 192, 256, 320, 384, 448}
+
 func CalculateDutyPeriod(frequency int) int {
 	return 16 * (2048 - frequency)
 }
 
+// dacEnabled reports whether the envelope register of channel 1, 2 or 4
+// powers the DAC: an initial volume of 0 with decreasing direction turns it
+// off, which also silences the channel.
+func dacEnabled(cnt uint16) bool {
+	return cnt&0xF800 != 0
+}
+
+// lengthCounter disables its channel when it reaches zero. It is loaded
+// from the length field of the control register and clocked at 256 Hz by
+// the frame sequencer while the length flag is set.
+type lengthCounter struct {
+	counter int
+}
+
+func (l *lengthCounter) load(max int, length int) {
+	l.counter = max - length
+}
+
+// trigger reloads an expired counter with the full length.
+func (l *lengthCounter) trigger(max int) {
+	if l.counter == 0 {
+		l.counter = max
+	}
+}
+
+// clock returns true when the counter expires.
+func (l *lengthCounter) clock(enabled bool) bool {
+	if !enabled || l.counter == 0 {
+		return false
+	}
+	l.counter--
+	return l.counter == 0
+}
+
+// envelope steps the volume of channels 1, 2 and 4 once every n ticks of
+// the 64 Hz frame sequencer step, n being bits 8-10 of the control
+// register (0 stops it).
+type envelope struct {
+	volume int
+	timer  int
+}
+
+func (env *envelope) trigger(cnt uint16) {
+	env.volume = int((cnt >> 12) & 0xF)
+	env.timer = int((cnt >> 8) & 0x7)
+}
+
+func (env *envelope) clock(cnt uint16) {
+	period := int((cnt >> 8) & 0x7)
+	if period == 0 {
+		return
+	}
+	env.timer--
+	if env.timer > 0 {
+		return
+	}
+	env.timer = period
+	if (cnt & (1 << 11)) != 0 {
+		env.volume = min(env.volume+1, 15)
+	} else {
+		env.volume = max(env.volume-1, 0)
+	}
+}
+
 type Channel1 struct {
 	CNT_L uint16
 	CNT_H uint16
 	CNT_X uint16
 
-	dutyCounter     int
-	sweepCounter    int
-	envelopeCounter int
-	lengthCounter   int
-
-	sweepPeriod    int
-	envelopePeriod int
-	lengthPeriod   int
+	dutyCounter int
+	dutyStep    int
+	length      lengthCounter
+	envelope    envelope
 
-	dutyStep  int
-	frequency int
-	volume    int
+	// Sweep unit
+	shadow       int
+	sweepCounter int
+	sweepEnabled bool
 
 	enabled bool
 }
 
-func (ch *Channel1) Start() {
-	ch.dutyStep = 0
-	ch.frequency = int(ch.CNT_X & 0x7FF)
-	ch.volume = int((ch.CNT_H >> 12) & 0xF)
+func (ch *Channel1) WriteCNT_L(value uint16) {
+	ch.CNT_L = value & 0x7F
+}
 
-	ch.sweepPeriod = systemClock / 128 * int((ch.CNT_L>>4)&0x7)
-	ch.envelopePeriod = systemClock / 64 * int((ch.CNT_H>>8)&0x7)
-	ch.lengthPeriod = systemClock / 256 * (64 - int(ch.CNT_H&0x3F))
+func (ch *Channel1) WriteCNT_H(value uint16) {
+	ch.CNT_H = value
+	ch.length.load(64, int(value&0x3F))
+	if !dacEnabled(value) {
+		ch.enabled = false
+	}
+}
 
-	ch.dutyCounter = CalculateDutyPeriod(ch.frequency)
-	ch.sweepCounter = ch.sweepPeriod
-	ch.envelopeCounter = ch.envelopePeriod
-	ch.lengthCounter = ch.lengthPeriod
+// WriteCNT_X stores the frequency and length flag; bit 15 restarts the
+// sound.
+func (ch *Channel1) WriteCNT_X(value uint16) {
+	ch.CNT_X = value & 0x47FF
+	if (value & (1 << 15)) != 0 {
+		ch.Start()
+	}
+}
 
-	ch.enabled = true
+func (ch *Channel1) Start() {
+	ch.enabled = dacEnabled(ch.CNT_H)
+	ch.length.trigger(64)
+	ch.envelope.trigger(ch.CNT_H)
+	ch.dutyCounter = CalculateDutyPeriod(int(ch.CNT_X & 0x7FF))
+
+	ch.shadow = int(ch.CNT_X & 0x7FF)
+	ch.sweepCounter = ch.sweepPeriod()
+	ch.sweepEnabled = (ch.CNT_L & 0x77) != 0
+	if (ch.CNT_L&0x7) != 0 && ch.sweepFrequency() > 2047 {
+		ch.enabled = false
+	}
 }
 
-func (ch *Channel1) Step() {
-	ch.dutyCounter--
-	if ch.dutyCounter <= 0 {
-		ch.dutyCounter = CalculateDutyPeriod(ch.frequency)
-		ch.dutyStep = (ch.dutyStep + 1) & 7
+// sweepPeriod returns the sweep time in 128 Hz ticks. A sweep time of 0
+// reloads the counter with 8 but never changes the frequency.
+func (ch *Channel1) sweepPeriod() int {
+	if period := int((ch.CNT_L >> 4) & 0x7); period != 0 {
+		return period
 	}
-	if ch.sweepPeriod > 0 {
-		ch.sweepCounter--
-		if ch.sweepCounter <= 0 {
-			ch.sweepCounter = ch.sweepPeriod
-			dx := ch.frequency >> int(ch.CNT_L&0x7)
-			if (ch.CNT_L & (1 << 3)) == 0 {
-				ch.frequency += dx
-			} else {
-				ch.frequency -= dx
-			}
-			if ch.frequency < 0 || ch.frequency > 2047 {
-				ch.enabled = false
-				return
-			}
-			ch.CNT_X = (ch.CNT_X & 0xF800) | uint16(ch.frequency)
-		}
+	return 8
+}
+
+func (ch *Channel1) sweepFrequency() int {
+	delta := ch.shadow >> (ch.CNT_L & 0x7)
+	if (ch.CNT_L & (1 << 3)) != 0 {
+		return ch.shadow - delta
 	}
-	if ch.envelopePeriod > 0 {
-		ch.envelopeCounter--
-		if ch.envelopeCounter <= 0 {
-			ch.envelopeCounter = ch.envelopePeriod
-			if (ch.CNT_H & (1 << 11)) != 0 {
-				ch.volume = min(ch.volume+1, 15)
-			} else {
-				ch.volume = max(ch.volume-1, 0)
-			}
-		}
+	return ch.shadow + delta
+}
+
+func (ch *Channel1) ClockSweep() {
+	ch.sweepCounter--
+	if ch.sweepCounter > 0 {
+		return
+	}
+	ch.sweepCounter = ch.sweepPeriod()
+	if !ch.sweepEnabled || (ch.CNT_L&0x70) == 0 {
+		return
 	}
-	if (ch.CNT_X & (1 << 14)) != 0 {
-		ch.lengthCounter--
-		if ch.lengthCounter <= 0 {
+	frequency := ch.sweepFrequency()
+	if frequency > 2047 {
+		ch.enabled = false
+		return
+	}
+	if (ch.CNT_L & 0x7) != 0 {
+		ch.shadow = frequency
+		ch.CNT_X = (ch.CNT_X & 0xF800) | uint16(frequency)
+		// The next value is checked right away as well.
+		if ch.sweepFrequency() > 2047 {
 			ch.enabled = false
 		}
 	}
 }
 
+func (ch *Channel1) ClockLength() {
+	if ch.length.clock((ch.CNT_X & (1 << 14)) != 0) {
+		ch.enabled = false
+	}
+}
+
+func (ch *Channel1) ClockEnvelope() {
+	ch.envelope.clock(ch.CNT_H)
+}
+
+func (ch *Channel1) Step(cycles int) {
+	if !ch.enabled {
+		return
+	}
+	ch.dutyCounter -= cycles
+	for ch.dutyCounter <= 0 {
+		ch.dutyCounter += CalculateDutyPeriod(int(ch.CNT_X & 0x7FF))
+		ch.dutyStep = (ch.dutyStep + 1) & 7
+	}
+}
+
 func (ch *Channel1) Output() int {
 	pattern := int((ch.CNT_H >> 6) & 0x3)
 	if ch.enabled && waveDuty[pattern][ch.dutyStep] {
-		return ch.volume
+		return ch.envelope.volume
 	}
 	return 0
 }
@@ -111,115 +225,157 @@ type Channel2 struct {
 	CNT_L uint16
 	CNT_H uint16
 
-	dutyCounter     int
-	envelopeCounter int
-	lengthCounter   int
+	dutyCounter int
+	dutyStep    int
+	length      lengthCounter
+	envelope    envelope
 
-	envelopePeriod int
-	lengthPeriod   int
+	enabled bool
+}
 
-	dutyStep  int
-	frequency int
-	volume    int
+func (ch *Channel2) WriteCNT_L(value uint16) {
+	ch.CNT_L = value
+	ch.length.load(64, int(value&0x3F))
+	if !dacEnabled(value) {
+		ch.enabled = false
+	}
+}
 
-	enabled bool
+func (ch *Channel2) WriteCNT_H(value uint16) {
+	ch.CNT_H = value & 0x47FF
+	if (value & (1 << 15)) != 0 {
+		ch.Start()
+	}
 }
 
 func (ch *Channel2) Start() {
-	ch.dutyStep = 0
-	ch.frequency = int(ch.CNT_H & 0x7FF)
-	ch.volume = int((ch.CNT_L >> 12) & 0xF)
-
-	ch.envelopePeriod = systemClock / 64 * int((ch.CNT_L>>8)&0x7)
-	ch.lengthPeriod = systemClock / 256 * (64 - int(ch.CNT_L&0x3F))
+	ch.enabled = dacEnabled(ch.CNT_L)
+	ch.length.trigger(64)
+	ch.envelope.trigger(ch.CNT_L)
+	ch.dutyCounter = CalculateDutyPeriod(int(ch.CNT_H & 0x7FF))
+}
 
-	ch.dutyCounter = CalculateDutyPeriod(ch.frequency)
-	ch.envelopeCounter = ch.envelopePeriod
-	ch.lengthCounter = ch.lengthPeriod
+func (ch *Channel2) ClockLength() {
+	if ch.length.clock((ch.CNT_H & (1 << 14)) != 0) {
+		ch.enabled = false
+	}
+}
 
-	ch.enabled = true
+func (ch *Channel2) ClockEnvelope() {
+	ch.envelope.clock(ch.CNT_L)
 }
 
-func (ch *Channel2) Step() {
-	ch.dutyCounter--
-	if ch.dutyCounter <= 0 {
-		ch.dutyCounter = CalculateDutyPeriod(ch.frequency)
-		ch.dutyStep = (ch.dutyStep + 1) & 7
+func (ch *Channel2) Step(cycles int) {
+	if !ch.enabled {
+		return
 	}
-	if ch.envelopePeriod > 0 {
-		ch.envelopeCounter--
-		if ch.envelopeCounter <= 0 {
-			ch.envelopeCounter = ch.envelopePeriod
-			if (ch.CNT_L & (1 << 11)) != 0 {
-				ch.volume = min(ch.volume+1, 15)
-			} else {
-				ch.volume = max(ch.volume-1, 0)
-			}
-		}
-	}
-	if (ch.CNT_H & (1 << 14)) != 0 {
-		ch.lengthCounter--
-		if ch.lengthCounter <= 0 {
-			ch.enabled = false
-		}
+	ch.dutyCounter -= cycles
+	for ch.dutyCounter <= 0 {
+		ch.dutyCounter += CalculateDutyPeriod(int(ch.CNT_H & 0x7FF))
+		ch.dutyStep = (ch.dutyStep + 1) & 7
 	}
 }
 
 func (ch *Channel2) Output() int {
 	pattern := int((ch.CNT_L >> 6) & 0x3)
 	if ch.enabled && waveDuty[pattern][ch.dutyStep] {
-		return ch.volume
+		return ch.envelope.volume
 	}
 	return 0
 }
 
+// Channel3 plays 4-bit samples from two 16-byte wave RAM banks. SOUND3CNT_L
+// bit 6 selects the bank being played; with bit 5 set the hardware flips it
+// after each 32 samples, so both banks play as one 64-sample wave. The CPU
+// always sees the other bank at WAVE_RAM.
 type Channel3 struct {
 	CNT_L uint16
 	CNT_H uint16
 	CNT_X uint16
-	RAM   [32]byte
+	RAM   [32]byte // bank 0, then bank 1
 
-	stepCounter   int
-	lengthCounter int
+	stepCounter int
+	waveIndex   int // sample position in the selected bank
+	length      lengthCounter
 
-	stepPeriod   int
-	lengthPeriod int
+	enabled bool
+}
 
-	waveIndex int
+// WriteCNT_L stores the wave RAM bank settings. Bit 7 is the DAC: clearing
+// it stops the channel.
+func (ch *Channel3) WriteCNT_L(value uint16) {
+	ch.CNT_L = value & 0xE0
+	if (value & (1 << 7)) == 0 {
+		ch.enabled = false
+	}
+}
 
-	enabled bool
+// ReadRAM returns a byte of the bank that is not selected for playback.
+func (ch *Channel3) ReadRAM(index int) byte {
+	return ch.RAM[ch.cpuBank()*16+index]
 }
 
-func (ch *Channel3) Start() {
-	ch.waveIndex = 0
+func (ch *Channel3) WriteRAM(index int, value byte) {
+	ch.RAM[ch.cpuBank()*16+index] = value
+}
 
-	ch.stepPeriod = 2 * (2048 - int(ch.CNT_X&0x7FF))
-	ch.lengthPeriod = systemClock / 256 * (256 - int(ch.CNT_H&0xFF))
+func (ch *Channel3) cpuBank() int {
+	return 1 - ch.playBank()
+}
 
-	ch.stepCounter = ch.stepPeriod
-	ch.lengthCounter = ch.lengthPeriod
+func (ch *Channel3) playBank() int {
+	return int((ch.CNT_L >> 6) & 1)
+}
 
-	ch.enabled = true
+func (ch *Channel3) WriteCNT_H(value uint16) {
+	ch.CNT_H = value & 0xE0FF
+	ch.length.load(256, int(value&0xFF))
 }
 
-func (ch *Channel3) Step() {
-	ch.stepCounter--
-	if ch.stepCounter <= 0 {
-		ch.stepCounter = ch.stepPeriod
-		ch.waveIndex = (ch.waveIndex + 1) & 0x3F
+func (ch *Channel3) WriteCNT_X(value uint16) {
+	ch.CNT_X = value & 0x47FF
+	if (value & (1 << 15)) != 0 {
+		ch.Start()
 	}
-	if (ch.CNT_X & (1 << 14)) != 0 {
-		ch.lengthCounter--
-		if ch.lengthCounter <= 0 {
-			ch.enabled = false
+}
+
+// CalculateStepPeriod returns the cycles per 4-bit sample.
+func (ch *Channel3) CalculateStepPeriod() int {
+	return 8 * (2048 - int(ch.CNT_X&0x7FF))
+}
+
+// Start plays the wave from the first sample of the selected bank.
+func (ch *Channel3) Start() {
+	ch.enabled = (ch.CNT_L & (1 << 7)) != 0
+	ch.length.trigger(256)
+	ch.waveIndex = 0
+	ch.stepCounter = ch.CalculateStepPeriod()
+}
+
+func (ch *Channel3) ClockLength() {
+	if ch.length.clock((ch.CNT_X & (1 << 14)) != 0) {
+		ch.enabled = false
+	}
+}
+
+func (ch *Channel3) Step(cycles int) {
+	if !ch.enabled {
+		return
+	}
+	ch.stepCounter -= cycles
+	for ch.stepCounter <= 0 {
+		ch.stepCounter += ch.CalculateStepPeriod()
+		ch.waveIndex = (ch.waveIndex + 1) & 0x1F
+		if ch.waveIndex == 0 && (ch.CNT_L&(1<<5)) != 0 {
+			ch.CNT_L ^= 1 << 6
 		}
 	}
 }
 
 func (ch *Channel3) Output() int {
-	if ch.enabled && (ch.CNT_L&(1<<7)) != 0 {
+	if ch.enabled {
 		var volume int
-		sampleIndex := ch.waveIndex / 2
+		sampleIndex := ch.playBank()*16 + ch.waveIndex/2
 		if (ch.waveIndex & 1) == 0 {
 			volume = int((ch.RAM[sampleIndex] >> 4) & 0xF)
 		} else {
@@ -247,52 +403,65 @@ type Channel4 struct {
 	CNT_L uint16
 	CNT_H uint16
 
-	stepCounter     int
-	envelopeCounter int
-	lengthCounter   int
+	stepCounter int
+	length      lengthCounter
+	envelope    envelope
+	state       int
 
-	stepPeriod     int
-	envelopePeriod int
-	lengthPeriod   int
+	enabled bool
+}
 
-	volume int
-	state  int
+func (ch *Channel4) WriteCNT_L(value uint16) {
+	ch.CNT_L = value
+	ch.length.load(64, int(value&0x3F))
+	if !dacEnabled(value) {
+		ch.enabled = false
+	}
+}
 
-	enabled bool
+func (ch *Channel4) WriteCNT_H(value uint16) {
+	ch.CNT_H = value & 0x40FF
+	if (value & (1 << 15)) != 0 {
+		ch.Start()
+	}
+}
+
+// CalculateStepPeriod returns the cycles per shift of the noise LFSR.
+func (ch *Channel4) CalculateStepPeriod() int {
+	r := ch.CNT_H & 0x7
+	s := (ch.CNT_H >> 4) & 0xF
+	return noiseDivisors[r] << s
 }
 
 func (ch *Channel4) Start() {
-	ch.volume = int((ch.CNT_L >> 12) & 0xF)
+	ch.enabled = dacEnabled(ch.CNT_L)
+	ch.length.trigger(64)
+	ch.envelope.trigger(ch.CNT_L)
 	if (ch.CNT_H & (1 << 3)) != 0 { // 7 bits
 		ch.state = 0x40
 	} else { // 15 bits
 		ch.state = 0x4000
 	}
+	ch.stepCounter = ch.CalculateStepPeriod()
+}
 
-	r := int(ch.CNT_H & 7)
-	s := int((ch.CNT_H >> 4) & 7)
-
-	ch.stepPeriod = 32
-	if r == 0 {
-		ch.stepPeriod /= 2
-	} else {
-		ch.stepPeriod *= r
+func (ch *Channel4) ClockLength() {
+	if ch.length.clock((ch.CNT_H & (1 << 14)) != 0) {
+		ch.enabled = false
 	}
-	ch.stepPeriod <<= s + 1
-	ch.envelopePeriod = systemClock / 64 * int((ch.CNT_L>>8)&0x7)
-	ch.lengthPeriod = systemClock / 256 * (64 - int(ch.CNT_L&0x3F))
-
-	ch.stepCounter = ch.stepPeriod
-	ch.envelopeCounter = ch.envelopePeriod
-	ch.lengthCounter = ch.lengthPeriod
+}
 
-	ch.enabled = true
+func (ch *Channel4) ClockEnvelope() {
+	ch.envelope.clock(ch.CNT_L)
 }
 
-func (ch *Channel4) Step() {
-	ch.stepCounter--
-	if ch.stepCounter <= 0 {
-		ch.stepCounter = ch.stepPeriod
+func (ch *Channel4) Step(cycles int) {
+	if !ch.enabled {
+		return
+	}
+	ch.stepCounter -= cycles
+	for ch.stepCounter <= 0 {
+		ch.stepCounter += ch.CalculateStepPeriod()
 		carry := (ch.state & 1) != 0
 		ch.state >>= 1
 		if carry {
@@ -303,28 +472,11 @@ func (ch *Channel4) Step() {
 			}
 		}
 	}
-	if ch.envelopePeriod > 0 {
-		ch.envelopeCounter--
-		if ch.envelopeCounter <= 0 {
-			ch.envelopeCounter = ch.envelopePeriod
-			if (ch.CNT_L & (1 << 11)) != 0 {
-				ch.volume = min(ch.volume+1, 15)
-			} else {
-				ch.volume = max(ch.volume-1, 0)
-			}
-		}
-	}
-	if (ch.CNT_H & (1 << 14)) != 0 {
-		ch.lengthCounter--
-		if ch.lengthCounter <= 0 {
-			ch.enabled = false
-		}
-	}
 }
 
 func (ch *Channel4) Output() int {
 	if ch.enabled && (ch.state&1) != 0 {
-		return ch.volume
+		return ch.envelope.volume
 	}
 	return 0
 }
@@ -337,22 +489,111 @@ type APU struct {
 
 	SOUNDCNT_L uint16
 	SOUNDCNT_H uint16
+	SOUNDCNT_X uint16
+	SOUNDBIAS  uint16
+
+	frameStep int
+
+	dmaSound  [2]int8
+	FIFO      [2][]byte
+	DMA       [4]*dma.Channel
+	Scheduler *scheduler.Scheduler
+
+	// Resampling of the mixer output to the host rate
+	blip    [2]blipBuffer // left, right
+	blipOut [2][]float32
+	output  ringBuffer
+}
+
+func NewAPU(dma [4]*dma.Channel, scheduler *scheduler.Scheduler) *APU {
+	apu := &APU{
+		Channel1:  &Channel1{},
+		Channel2:  &Channel2{},
+		Channel3:  &Channel3{},
+		Channel4:  &Channel4{},
+		DMA:       dma,
+		Scheduler: scheduler,
+	}
+	apu.SetSampleRate(defaultSampleRate)
+	apu.setupEvents()
+	return apu
+}
+
+// SetSampleRate sets the rate of the frames returned by ReadFrames. Frames
+// not read yet are dropped.
+func (apu *APU) SetSampleRate(rate int) {
+	apu.blip[0].setRate(rate)
+	apu.blip[1].setRate(rate)
+	apu.output.clear()
+}
 
-	dmaSound   [2]int8
-	FIFO       [2][]byte
-	DMA        [4]*dma.Channel
-	cycles     uint64
-	StreamerCh chan float32
+// ReadFrames pulls up to len(frames) left/right frames in [-1, 1] and
+// returns the number read. It can be called from another goroutine.
+func (apu *APU) ReadFrames(frames [][2]float32) int {
+	return apu.output.read(frames)
 }
 
-func NewAPU(dma [4]*dma.Channel) *APU {
-	return &APU{
-		Channel1: &Channel1{},
-		Channel2: &Channel2{},
-		Channel3: &Channel3{},
-		Channel4: &Channel4{},
-		DMA:      dma,
+func (apu *APU) setupEvents() {
+	apu.Scheduler.Handle(scheduler.EventAPUSample, apu.Sample)
+	apu.Scheduler.Schedule(scheduler.EventAPUSample, cyclesPerSample)
+	apu.Scheduler.Handle(scheduler.EventAPUFrame, apu.StepFrameSequencer)
+	apu.Scheduler.Schedule(scheduler.EventAPUFrame, cyclesPerFrameStep)
+}
+
+func (apu *APU) StepFrameSequencer() {
+	if (apu.frameStep & 1) == 0 {
+		apu.Channel1.ClockLength()
+		apu.Channel2.ClockLength()
+		apu.Channel3.ClockLength()
+		apu.Channel4.ClockLength()
+	}
+	if apu.frameStep == 2 || apu.frameStep == 6 {
+		apu.Channel1.ClockSweep()
 	}
+	if apu.frameStep == 7 {
+		apu.Channel1.ClockEnvelope()
+		apu.Channel2.ClockEnvelope()
+		apu.Channel4.ClockEnvelope()
+	}
+	apu.frameStep = (apu.frameStep + 1) & 7
+	apu.Scheduler.Schedule(scheduler.EventAPUFrame, cyclesPerFrameStep)
+}
+
+// ReadSOUNDCNT_X returns the master enable and the channel 1-4 status
+// flags in bits 0-3.
+func (apu *APU) ReadSOUNDCNT_X() uint16 {
+	value := apu.SOUNDCNT_X
+	for i, enabled := range []bool{
+		apu.Channel1.enabled,
+		apu.Channel2.enabled,
+		apu.Channel3.enabled,
+		apu.Channel4.enabled,
+	} {
+		if enabled {
+			value |= 1 << i
+		}
+	}
+	return value
+}
+
+// WriteSOUNDCNT_X sets the master enable. Turning it off resets the PSG
+// registers and channels (the wave RAM is kept); turning it on restarts
+// the frame sequencer from step 0.
+func (apu *APU) WriteSOUNDCNT_X(value uint16) {
+	value &= 0x80
+	if value == apu.SOUNDCNT_X {
+		return
+	}
+	apu.SOUNDCNT_X = value
+	if value != 0 {
+		apu.frameStep = 0
+		return
+	}
+	*apu.Channel1 = Channel1{}
+	*apu.Channel2 = Channel2{}
+	*apu.Channel3 = Channel3{RAM: apu.Channel3.RAM}
+	*apu.Channel4 = Channel4{}
+	apu.SOUNDCNT_L = 0
 }
 
 func (apu *APU) FIFOPush(index int, value byte) {
@@ -389,33 +630,201 @@ func (apu *APU) TimerTick(index int) {
 	}
 }
 
-func (apu *APU) Step() {
-	apu.cycles++
-	apu.Channel1.Step()
-	apu.Channel2.Step()
-	apu.Channel3.Step()
-	apu.Channel4.Step()
-	// system clock 16*1024*1024 ≒ 16.78 MHz
-	// sampling rate is 32.768 KHz (system clock / 512)
-	if (apu.cycles & 0x1FF) == 0 {
-		apu.SendSample()
-	}
+// Sample catches the channels up to the current cycle and runs the mixer
+// at the sampling rate selected by SOUNDBIAS (32.768 KHz to 262.144 KHz).
+// The outputs are resampled to the host rate and queued for ReadFrames.
+func (apu *APU) Sample() {
+	interval := cyclesPerSample >> ((apu.SOUNDBIAS >> 14) & 0x3)
+	apu.Channel1.Step(interval)
+	apu.Channel2.Step(interval)
+	apu.Channel3.Step(interval)
+	apu.Channel4.Step(interval)
+
+	left, right := apu.Mix()
+	apu.blip[0].addSample(interval, left)
+	apu.blip[1].addSample(interval, right)
+	apu.blipOut[0] = apu.blip[0].read(apu.blipOut[0][:0])
+	apu.blipOut[1] = apu.blip[1].read(apu.blipOut[1][:0])
+	apu.output.write(apu.blipOut[0], apu.blipOut[1])
+
+	apu.Scheduler.Schedule(scheduler.EventAPUSample, interval)
 }
 
-func (apu *APU) SendSample() {
-	ch1 := float32(apu.Channel1.Output()) / 15
-	ch2 := float32(apu.Channel2.Output()) / 15
-	ch3 := float32(apu.Channel3.Output()) / 15
-	ch4 := float32(apu.Channel4.Output()) / 15
-	chA := float32(apu.dmaSound[0]) / 128
-	chB := float32(apu.dmaSound[1]) / 128
-	sample := min(max(ch1+ch2+ch3+ch4+chA+chB, -1), 1)
-	select {
-	case apu.StreamerCh <- sample:
-	default:
+// Mix returns the left and right outputs in [-1, 1]. The channels are
+// summed per side as SOUNDCNT_L and SOUNDCNT_H select, offset by the
+// SOUNDBIAS level, clipped to the 10-bit DAC range and reduced to its
+// amplitude resolution. The bias is taken out again, as the output
+// capacitor does.
+func (apu *APU) Mix() (left float32, right float32) {
+	if apu.SOUNDCNT_X == 0 {
+		return 0, 0
+	}
+	psg := [4]int{
+		apu.Channel1.Output(),
+		apu.Channel2.Output(),
+		apu.Channel3.Output(),
+		apu.Channel4.Output(),
 	}
-	select {
-	case apu.StreamerCh <- sample:
-	default:
+	bias := int(apu.SOUNDBIAS & 0x3FE)
+	resolution := (apu.SOUNDBIAS >> 14) & 0x3 // 9 bits minus resolution
+
+	var out [2]int
+	for side := 0; side < 2; side++ { // 0: right 1: left
+		sum := 0
+		for i, value := range psg {
+			if (apu.SOUNDCNT_L & (1 << (8 + 4*side + i))) != 0 {
+				sum += value
+			}
+		}
+		sum *= int((apu.SOUNDCNT_L>>(4*side))&0x7) + 1 // master volume
+		switch apu.SOUNDCNT_H & 0x3 {
+		case 0: // 25%
+			sum >>= 2
+		case 1: // 50%
+			sum >>= 1
+		}
+		for i := 0; i < 2; i++ { // DMA sound A/B
+			if (apu.SOUNDCNT_H & (1 << (8 + 4*i + side))) == 0 {
+				continue
+			}
+			value := int(apu.dmaSound[i])
+			if (apu.SOUNDCNT_H & (1 << (2 + i))) != 0 { // 100%
+				value *= 2
+			}
+			sum += value
+		}
+		level := min(max(sum+bias, 0), 0x3FF)
+		level &^= (2 << resolution) - 1
+		out[side] = level - bias
 	}
+	return float32(out[1]) / 512, float32(out[0]) / 512
+}
+
+func (ch *Channel1) SaveState(w *state.Writer) {
+	w.Write(ch.CNT_L)
+	w.Write(ch.CNT_H)
+	w.Write(ch.CNT_X)
+	w.WriteInt(ch.dutyCounter)
+	w.WriteInt(ch.dutyStep)
+	w.WriteInt(ch.length.counter)
+	w.WriteInt(ch.envelope.volume)
+	w.WriteInt(ch.envelope.timer)
+	w.WriteInt(ch.shadow)
+	w.WriteInt(ch.sweepCounter)
+	w.Write(ch.sweepEnabled)
+	w.Write(ch.enabled)
+}
+
+func (ch *Channel1) LoadState(r *state.Reader) {
+	r.Read(&ch.CNT_L)
+	r.Read(&ch.CNT_H)
+	r.Read(&ch.CNT_X)
+	r.ReadInt(&ch.dutyCounter)
+	r.ReadInt(&ch.dutyStep)
+	r.ReadInt(&ch.length.counter)
+	r.ReadInt(&ch.envelope.volume)
+	r.ReadInt(&ch.envelope.timer)
+	r.ReadInt(&ch.shadow)
+	r.ReadInt(&ch.sweepCounter)
+	r.Read(&ch.sweepEnabled)
+	r.Read(&ch.enabled)
+}
+
+func (ch *Channel2) SaveState(w *state.Writer) {
+	w.Write(ch.CNT_L)
+	w.Write(ch.CNT_H)
+	w.WriteInt(ch.dutyCounter)
+	w.WriteInt(ch.dutyStep)
+	w.WriteInt(ch.length.counter)
+	w.WriteInt(ch.envelope.volume)
+	w.WriteInt(ch.envelope.timer)
+	w.Write(ch.enabled)
+}
+
+func (ch *Channel2) LoadState(r *state.Reader) {
+	r.Read(&ch.CNT_L)
+	r.Read(&ch.CNT_H)
+	r.ReadInt(&ch.dutyCounter)
+	r.ReadInt(&ch.dutyStep)
+	r.ReadInt(&ch.length.counter)
+	r.ReadInt(&ch.envelope.volume)
+	r.ReadInt(&ch.envelope.timer)
+	r.Read(&ch.enabled)
+}
+
+func (ch *Channel3) SaveState(w *state.Writer) {
+	w.Write(ch.CNT_L)
+	w.Write(ch.CNT_H)
+	w.Write(ch.CNT_X)
+	w.Write(ch.RAM[:])
+	w.WriteInt(ch.stepCounter)
+	w.WriteInt(ch.waveIndex)
+	w.WriteInt(ch.length.counter)
+	w.Write(ch.enabled)
+}
+
+func (ch *Channel3) LoadState(r *state.Reader) {
+	r.Read(&ch.CNT_L)
+	r.Read(&ch.CNT_H)
+	r.Read(&ch.CNT_X)
+	r.Read(ch.RAM[:])
+	r.ReadInt(&ch.stepCounter)
+	r.ReadInt(&ch.waveIndex)
+	r.ReadInt(&ch.length.counter)
+	r.Read(&ch.enabled)
+}
+
+func (ch *Channel4) SaveState(w *state.Writer) {
+	w.Write(ch.CNT_L)
+	w.Write(ch.CNT_H)
+	w.WriteInt(ch.stepCounter)
+	w.WriteInt(ch.length.counter)
+	w.WriteInt(ch.envelope.volume)
+	w.WriteInt(ch.envelope.timer)
+	w.WriteInt(ch.state)
+	w.Write(ch.enabled)
+}
+
+func (ch *Channel4) LoadState(r *state.Reader) {
+	r.Read(&ch.CNT_L)
+	r.Read(&ch.CNT_H)
+	r.ReadInt(&ch.stepCounter)
+	r.ReadInt(&ch.length.counter)
+	r.ReadInt(&ch.envelope.volume)
+	r.ReadInt(&ch.envelope.timer)
+	r.ReadInt(&ch.state)
+	r.Read(&ch.enabled)
+}
+
+func (apu *APU) SaveState(w *state.Writer) {
+	apu.Channel1.SaveState(w)
+	apu.Channel2.SaveState(w)
+	apu.Channel3.SaveState(w)
+	apu.Channel4.SaveState(w)
+	w.Write(apu.SOUNDCNT_L)
+	w.Write(apu.SOUNDCNT_H)
+	w.Write(apu.SOUNDCNT_X)
+	w.Write(apu.SOUNDBIAS)
+	w.WriteInt(apu.frameStep)
+	w.Write(apu.dmaSound[:])
+	w.WriteBytes(apu.FIFO[0])
+	w.WriteBytes(apu.FIFO[1])
+}
+
+func (apu *APU) LoadState(r *state.Reader) {
+	apu.Channel1.LoadState(r)
+	apu.Channel2.LoadState(r)
+	apu.Channel3.LoadState(r)
+	apu.Channel4.LoadState(r)
+	r.Read(&apu.SOUNDCNT_L)
+	r.Read(&apu.SOUNDCNT_H)
+	r.Read(&apu.SOUNDCNT_X)
+	r.Read(&apu.SOUNDBIAS)
+	r.ReadInt(&apu.frameStep)
+	r.Read(apu.dmaSound[:])
+	apu.FIFO[0] = r.ReadBytes()
+	apu.FIFO[1] = r.ReadBytes()
+	// The resampler restarts from silence.
+	apu.blip[0].clear()
+	apu.blip[1].clear()
 }
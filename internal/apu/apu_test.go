@@ -0,0 +1,448 @@
+package apu
+
+import (
+	"math"
+	"testing"
+
+	"github.com/Div9851/gba-go/internal/dma"
+	"github.com/Div9851/gba-go/internal/scheduler"
+)
+
+type write struct {
+	reg   string
+	value uint16
+}
+
+func newTestAPU(t *testing.T, writes []write) (*APU, *scheduler.Scheduler) {
+	t.Helper()
+	s := scheduler.NewScheduler()
+	apu := NewAPU([4]*dma.Channel{}, s)
+	apu.WriteSOUNDCNT_X(0x80)
+	for _, w := range writes {
+		apu.write(t, w)
+	}
+	return apu, s
+}
+
+func (apu *APU) write(t *testing.T, w write) {
+	t.Helper()
+	switch w.reg {
+	case "SOUND1CNT_L":
+		apu.Channel1.WriteCNT_L(w.value)
+	case "SOUND1CNT_H":
+		apu.Channel1.WriteCNT_H(w.value)
+	case "SOUND1CNT_X":
+		apu.Channel1.WriteCNT_X(w.value)
+	case "SOUND2CNT_L":
+		apu.Channel2.WriteCNT_L(w.value)
+	case "SOUND2CNT_H":
+		apu.Channel2.WriteCNT_H(w.value)
+	case "SOUND3CNT_L":
+		apu.Channel3.WriteCNT_L(w.value)
+	case "SOUND3CNT_H":
+		apu.Channel3.WriteCNT_H(w.value)
+	case "SOUND3CNT_X":
+		apu.Channel3.WriteCNT_X(w.value)
+	case "SOUND4CNT_L":
+		apu.Channel4.WriteCNT_L(w.value)
+	case "SOUND4CNT_H":
+		apu.Channel4.WriteCNT_H(w.value)
+	case "SOUNDCNT_X":
+		apu.WriteSOUNDCNT_X(w.value)
+	default:
+		t.Fatalf("unknown register %s", w.reg)
+	}
+}
+
+// runFrameSteps advances the scheduler by n frame sequencer steps. The
+// first step after reset is step 0.
+func runFrameSteps(s *scheduler.Scheduler, n int) {
+	s.Advance(n * cyclesPerFrameStep)
+}
+
+func TestLengthCounter(t *testing.T) {
+	tests := []struct {
+		name   string
+		writes []write
+		steps  int
+		want   uint16 // SOUNDCNT_X status bits
+	}{
+		{
+			name:   "ch1 length 63 expires on the first clock",
+			writes: []write{{"SOUND1CNT_H", 0xF03F}, {"SOUND1CNT_X", 0xC000}},
+			steps:  1,
+			want:   0x0,
+		},
+		{
+			name:   "ch1 length 62 needs two clocks",
+			writes: []write{{"SOUND1CNT_H", 0xF03E}, {"SOUND1CNT_X", 0xC000}},
+			steps:  2,
+			want:   0x1,
+		},
+		{
+			name:   "ch1 length 62 expires on step 2",
+			writes: []write{{"SOUND1CNT_H", 0xF03E}, {"SOUND1CNT_X", 0xC000}},
+			steps:  3,
+			want:   0x0,
+		},
+		{
+			name:   "length disabled keeps playing",
+			writes: []write{{"SOUND2CNT_L", 0xF03F}, {"SOUND2CNT_H", 0x8000}},
+			steps:  16,
+			want:   0x2,
+		},
+		{
+			name:   "ch3 counts 256",
+			writes: []write{{"SOUND3CNT_L", 0x80}, {"SOUND3CNT_H", 0x00FE}, {"SOUND3CNT_X", 0xC000}},
+			steps:  3,
+			want:   0x0,
+		},
+		{
+			name:   "ch4 length 0 reloads 64 on trigger",
+			writes: []write{{"SOUND4CNT_L", 0xF000}, {"SOUND4CNT_H", 0xC000}},
+			steps:  126,
+			want:   0x8,
+		},
+		{
+			name:   "ch4 length 0 expires after 64 clocks",
+			writes: []write{{"SOUND4CNT_L", 0xF000}, {"SOUND4CNT_H", 0xC000}},
+			steps:  127,
+			want:   0x0,
+		},
+		{
+			name: "retrigger keeps the remaining length",
+			writes: []write{
+				{"SOUND1CNT_H", 0xF03E}, {"SOUND1CNT_X", 0xC000},
+				{"SOUND1CNT_X", 0xC000},
+			},
+			steps: 3,
+			want:  0x0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			apu, s := newTestAPU(t, tt.writes)
+			runFrameSteps(s, tt.steps)
+			if got := apu.ReadSOUNDCNT_X() & 0xF; got != tt.want {
+				t.Errorf("status = %#x, want %#x", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDAC(t *testing.T) {
+	tests := []struct {
+		name   string
+		writes []write
+		want   uint16
+	}{
+		{
+			name:   "trigger with the DAC off does not start",
+			writes: []write{{"SOUND1CNT_H", 0x0000}, {"SOUND1CNT_X", 0x8000}},
+			want:   0x0,
+		},
+		{
+			name:   "increasing envelope from 0 powers the DAC",
+			writes: []write{{"SOUND2CNT_L", 0x0800}, {"SOUND2CNT_H", 0x8000}},
+			want:   0x2,
+		},
+		{
+			name: "turning the DAC off stops the channel",
+			writes: []write{
+				{"SOUND4CNT_L", 0xF000}, {"SOUND4CNT_H", 0x8000},
+				{"SOUND4CNT_L", 0x0700},
+			},
+			want: 0x0,
+		},
+		{
+			name: "turning the DAC back on does not restart",
+			writes: []write{
+				{"SOUND1CNT_H", 0xF000}, {"SOUND1CNT_X", 0x8000},
+				{"SOUND1CNT_H", 0x0000}, {"SOUND1CNT_H", 0xF000},
+			},
+			want: 0x0,
+		},
+		{
+			name:   "ch3 needs SOUND3CNT_L bit 7",
+			writes: []write{{"SOUND3CNT_L", 0x00}, {"SOUND3CNT_X", 0x8000}},
+			want:   0x0,
+		},
+		{
+			name: "ch3 DAC off stops the channel",
+			writes: []write{
+				{"SOUND3CNT_L", 0x80}, {"SOUND3CNT_X", 0x8000},
+				{"SOUND3CNT_L", 0x00},
+			},
+			want: 0x0,
+		},
+		{
+			name: "master disable resets all channels",
+			writes: []write{
+				{"SOUND1CNT_H", 0xF000}, {"SOUND1CNT_X", 0x8000},
+				{"SOUND3CNT_L", 0x80}, {"SOUND3CNT_X", 0x8000},
+				{"SOUNDCNT_X", 0x00}, {"SOUNDCNT_X", 0x80},
+			},
+			want: 0x0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			apu, _ := newTestAPU(t, tt.writes)
+			if got := apu.ReadSOUNDCNT_X() & 0xF; got != tt.want {
+				t.Errorf("status = %#x, want %#x", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEnvelope(t *testing.T) {
+	tests := []struct {
+		name   string
+		writes []write
+		steps  int
+		want   int
+	}{
+		{
+			name:   "no clock before step 7",
+			writes: []write{{"SOUND2CNT_L", 0xF100}, {"SOUND2CNT_H", 0x8000}},
+			steps:  7,
+			want:   15,
+		},
+		{
+			name:   "decrease every 64 Hz tick",
+			writes: []write{{"SOUND2CNT_L", 0xF100}, {"SOUND2CNT_H", 0x8000}},
+			steps:  16,
+			want:   13,
+		},
+		{
+			name:   "increase every second tick",
+			writes: []write{{"SOUND2CNT_L", 0x3A00}, {"SOUND2CNT_H", 0x8000}},
+			steps:  32,
+			want:   5,
+		},
+		{
+			name:   "stops at 15",
+			writes: []write{{"SOUND2CNT_L", 0xE900}, {"SOUND2CNT_H", 0x8000}},
+			steps:  64,
+			want:   15,
+		},
+		{
+			name:   "step time 0 holds the volume",
+			writes: []write{{"SOUND2CNT_L", 0x8000}, {"SOUND2CNT_H", 0x8000}},
+			steps:  64,
+			want:   8,
+		},
+		{
+			name: "retrigger reloads the volume",
+			writes: []write{
+				{"SOUND2CNT_L", 0xF100}, {"SOUND2CNT_H", 0x8000},
+				{"SOUND2CNT_L", 0x7000}, {"SOUND2CNT_H", 0x8000},
+			},
+			steps: 16,
+			want:  7,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			apu, s := newTestAPU(t, tt.writes)
+			runFrameSteps(s, tt.steps)
+			if got := apu.Channel2.envelope.volume; got != tt.want {
+				t.Errorf("volume = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSweep(t *testing.T) {
+	tests := []struct {
+		name        string
+		writes      []write
+		steps       int
+		wantFreq    uint16
+		wantEnabled bool
+	}{
+		{
+			name:        "increase on step 2",
+			writes:      []write{{"SOUND1CNT_L", 0x11}, {"SOUND1CNT_H", 0xF000}, {"SOUND1CNT_X", 0x8100}},
+			steps:       3,
+			wantFreq:    0x180,
+			wantEnabled: true,
+		},
+		{
+			name:        "decrease twice",
+			writes:      []write{{"SOUND1CNT_L", 0x19}, {"SOUND1CNT_H", 0xF000}, {"SOUND1CNT_X", 0x8400}},
+			steps:       7,
+			wantFreq:    0x100,
+			wantEnabled: true,
+		},
+		{
+			name:        "sweep time 2 skips a tick",
+			writes:      []write{{"SOUND1CNT_L", 0x21}, {"SOUND1CNT_H", 0xF000}, {"SOUND1CNT_X", 0x8100}},
+			steps:       3,
+			wantFreq:    0x100,
+			wantEnabled: true,
+		},
+		{
+			name:        "overflow at trigger",
+			writes:      []write{{"SOUND1CNT_L", 0x11}, {"SOUND1CNT_H", 0xF000}, {"SOUND1CNT_X", 0x87FF}},
+			steps:       0,
+			wantFreq:    0x7FF,
+			wantEnabled: false,
+		},
+		{
+			name:        "overflow of the next value",
+			writes:      []write{{"SOUND1CNT_L", 0x11}, {"SOUND1CNT_H", 0xF000}, {"SOUND1CNT_X", 0x8500}},
+			steps:       3,
+			wantFreq:    0x780,
+			wantEnabled: false,
+		},
+		{
+			name:        "shift 0 checks overflow without writing",
+			writes:      []write{{"SOUND1CNT_L", 0x10}, {"SOUND1CNT_H", 0xF000}, {"SOUND1CNT_X", 0x8500}},
+			steps:       3,
+			wantFreq:    0x500,
+			wantEnabled: false,
+		},
+		{
+			name:        "shift 0 at trigger",
+			writes:      []write{{"SOUND1CNT_L", 0x10}, {"SOUND1CNT_H", 0xF000}, {"SOUND1CNT_X", 0x8300}},
+			steps:       3,
+			wantFreq:    0x300,
+			wantEnabled: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			apu, s := newTestAPU(t, tt.writes)
+			runFrameSteps(s, tt.steps)
+			if got := apu.Channel1.CNT_X & 0x7FF; got != tt.wantFreq {
+				t.Errorf("frequency = %#x, want %#x", got, tt.wantFreq)
+			}
+			if got := apu.Channel1.enabled; got != tt.wantEnabled {
+				t.Errorf("enabled = %v, want %v", got, tt.wantEnabled)
+			}
+		})
+	}
+}
+
+func TestFrequencyTimers(t *testing.T) {
+	tests := []struct {
+		name   string
+		writes []write
+		period func(apu *APU) int
+		want   int
+	}{
+		{
+			name:   "square 131072/(2048-n) Hz",
+			writes: []write{{"SOUND2CNT_H", 0x07FF}},
+			period: func(apu *APU) int { return CalculateDutyPeriod(int(apu.Channel2.CNT_H & 0x7FF)) },
+			want:   16,
+		},
+		{
+			name:   "wave 2097152/(2048-n) Hz",
+			writes: []write{{"SOUND3CNT_X", 0x0700}},
+			period: func(apu *APU) int { return apu.Channel3.CalculateStepPeriod() },
+			want:   2048,
+		},
+		{
+			name:   "noise r=0 s=0",
+			writes: []write{{"SOUND4CNT_H", 0x0000}},
+			period: func(apu *APU) int { return apu.Channel4.CalculateStepPeriod() },
+			want:   32,
+		},
+		{
+			name:   "noise r=1 s=2",
+			writes: []write{{"SOUND4CNT_H", 0x0021}},
+			period: func(apu *APU) int { return apu.Channel4.CalculateStepPeriod() },
+			want:   256,
+		},
+		{
+			name:   "noise r=7 s=13",
+			writes: []write{{"SOUND4CNT_H", 0x00D7}},
+			period: func(apu *APU) int { return apu.Channel4.CalculateStepPeriod() },
+			want:   448 << 13,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			apu, _ := newTestAPU(t, tt.writes)
+			if got := tt.period(apu); got != tt.want {
+				t.Errorf("period = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWaveBanks(t *testing.T) {
+	tests := []struct {
+		name     string
+		cntL     uint16
+		samples  int
+		wantBank uint16 // SOUND3CNT_L bit 6
+		want     int    // output, 1 from bank 0 and 15 from bank 1
+	}{
+		{"bank 0", 0x80, 0, 0, 1},
+		{"bank 1", 0xC0, 0, 1, 15},
+		{"32-sample mode repeats bank 0", 0x80, 32, 0, 1},
+		{"64-sample mode stays until the end of the bank", 0xA0, 31, 0, 1},
+		{"64-sample mode flips to bank 1", 0xA0, 32, 1, 15},
+		{"64-sample mode returns to bank 1 after both banks", 0xE0, 64, 1, 15},
+		{"64-sample mode from bank 1", 0xE0, 32, 0, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			apu, _ := newTestAPU(t, nil)
+			ch := apu.Channel3
+			// Fill each bank through WAVE_RAM, which maps the other one.
+			ch.WriteCNT_L(0x40)
+			for i := 0; i < 16; i++ {
+				ch.WriteRAM(i, 0x11)
+			}
+			ch.WriteCNT_L(0x00)
+			for i := 0; i < 16; i++ {
+				ch.WriteRAM(i, 0xFF)
+			}
+			ch.WriteCNT_L(tt.cntL)
+			ch.WriteCNT_H(0x2000)
+			ch.WriteCNT_X(0x87FF)
+			ch.Step(tt.samples * ch.CalculateStepPeriod())
+			if got := (ch.CNT_L >> 6) & 1; got != tt.wantBank {
+				t.Errorf("bank = %d, want %d", got, tt.wantBank)
+			}
+			if got := ch.Output(); got != tt.want {
+				t.Errorf("output = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBlipBuffer(t *testing.T) {
+	tests := []struct {
+		name  string
+		rate  int
+		level float32
+	}{
+		{"32768 Hz", 32768, 0.5},
+		{"44100 Hz", 44100, -0.25},
+		{"48000 Hz", 48000, 1},
+		{"96000 Hz", 96000, 0.75},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b blipBuffer
+			b.setRate(tt.rate)
+			var out []float32
+			// One second of a step held at the mixer rate
+			for i := 0; i < systemClock/cyclesPerSample; i++ {
+				b.addSample(cyclesPerSample, tt.level)
+				out = b.read(out)
+			}
+			if n := len(out); n < tt.rate-blipTaps || n > tt.rate {
+				t.Errorf("got %d samples, want about %d", n, tt.rate)
+			}
+			if got := out[len(out)-1]; math.Abs(float64(got-tt.level)) > 1e-6 {
+				t.Errorf("settled at %v, want %v", got, tt.level)
+			}
+		})
+	}
+}
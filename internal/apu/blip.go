@@ -0,0 +1,103 @@
+package apu
+
+import "math"
+
+// The mixer output is resampled to the host rate by band-limited synthesis,
+// in the style of blip_buf. The mixer level only changes at its own sample
+// ticks, so the output is a series of steps. Each step is added as a
+// windowed sinc impulse at its exact position between two output samples,
+// and reading integrates the impulses back into levels. The steps come out
+// band-limited, so square waves don't alias at 44.1 or 48 kHz.
+
+const (
+	blipPhases = 32   // kernel positions between two output samples
+	blipTaps   = 16   // kernel width in output samples
+	blipCutoff = 0.45 // in cycles per output sample, just below Nyquist
+)
+
+var blipKernel = newBlipKernel()
+
+func newBlipKernel() (kernel [blipPhases][blipTaps]float64) {
+	for p := range kernel {
+		frac := float64(p) / blipPhases
+		sum := 0.0
+		for i := range kernel[p] {
+			// Distance from the step to the output sample, with a
+			// Blackman window over the kernel width.
+			x := float64(i-blipTaps/2+1) - frac
+			u := x / (blipTaps / 2)
+			window := 0.42 + 0.5*math.Cos(math.Pi*u) + 0.08*math.Cos(2*math.Pi*u)
+			kernel[p][i] = 2 * blipCutoff * sinc(2*blipCutoff*x) * window
+			sum += kernel[p][i]
+		}
+		// Each phase adds exactly the step size once integrated.
+		for i := range kernel[p] {
+			kernel[p][i] /= sum
+		}
+	}
+	return
+}
+
+func sinc(x float64) float64 {
+	if x == 0 {
+		return 1
+	}
+	return math.Sin(math.Pi*x) / (math.Pi * x)
+}
+
+type blipBuffer struct {
+	step   float64   // output samples per cycle
+	pos    float64   // current time in output samples from deltas[0]
+	deltas []float64 // impulses added to the pending output samples
+	level  float64   // integrated output
+	last   float32   // input level
+}
+
+func (b *blipBuffer) setRate(rate int) {
+	b.step = float64(rate) / systemClock
+	b.clear()
+}
+
+func (b *blipBuffer) clear() {
+	b.pos = blipTaps/2 - 1
+	b.deltas = b.deltas[:0]
+	b.level = 0
+	b.last = 0
+}
+
+// addSample advances the time by cycles and sets the input level there.
+func (b *blipBuffer) addSample(cycles int, value float32) {
+	b.pos += float64(cycles) * b.step
+	if value == b.last {
+		return
+	}
+	delta := float64(value - b.last)
+	b.last = value
+	n := int(b.pos)
+	kernel := &blipKernel[int((b.pos-float64(n))*blipPhases)]
+	start := n - blipTaps/2 + 1
+	for len(b.deltas) < start+blipTaps {
+		b.deltas = append(b.deltas, 0)
+	}
+	for i, k := range kernel {
+		b.deltas[start+i] += delta * k
+	}
+}
+
+// read appends the output samples that no later step can change anymore.
+func (b *blipBuffer) read(out []float32) []float32 {
+	ready := int(b.pos) - blipTaps/2 + 1
+	for i := 0; i < ready; i++ {
+		if i < len(b.deltas) {
+			b.level += b.deltas[i]
+		}
+		out = append(out, float32(b.level))
+	}
+	if ready < len(b.deltas) {
+		b.deltas = b.deltas[:copy(b.deltas, b.deltas[ready:])]
+	} else {
+		b.deltas = b.deltas[:0]
+	}
+	b.pos -= float64(ready)
+	return out
+}
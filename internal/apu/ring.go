@@ -0,0 +1,48 @@
+package apu
+
+import "sync"
+
+// About 85 ms at 48 kHz. When the host falls further behind, the oldest
+// frames are dropped so the latency stays bounded.
+const ringSize = 4096
+
+// ringBuffer passes the output frames from the emulator to the host audio
+// callback, which runs on its own goroutine and pulls them.
+type ringBuffer struct {
+	mu     sync.Mutex
+	frames [ringSize][2]float32
+	head   int // oldest frame
+	count  int
+}
+
+func (rb *ringBuffer) write(left []float32, right []float32) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	for i := range left {
+		if rb.count == ringSize {
+			rb.head = (rb.head + 1) % ringSize
+			rb.count--
+		}
+		rb.frames[(rb.head+rb.count)%ringSize] = [2]float32{left[i], right[i]}
+		rb.count++
+	}
+}
+
+func (rb *ringBuffer) read(frames [][2]float32) int {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	n := min(len(frames), rb.count)
+	for i := 0; i < n; i++ {
+		frames[i] = rb.frames[(rb.head+i)%ringSize]
+	}
+	rb.head = (rb.head + n) % ringSize
+	rb.count -= n
+	return n
+}
+
+func (rb *ringBuffer) clear() {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	rb.head = 0
+	rb.count = 0
+}
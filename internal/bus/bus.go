@@ -4,6 +4,7 @@ import (
 	"github.com/Div9851/gba-go/internal/gamepak"
 	"github.com/Div9851/gba-go/internal/ioreg"
 	"github.com/Div9851/gba-go/internal/ppu"
+	"github.com/Div9851/gba-go/internal/state"
 )
 
 type Bus struct {
@@ -13,8 +14,31 @@ type Bus struct {
 	GamePak *gamepak.GamePak
 	PPU     *ppu.PPU
 	IOReg   *ioreg.IOReg
+
+	// Access cycles indexed by [sequential][addr>>24], from WAITCNT
+	waitcnt  uint16
+	cycles16 [2][16]int
+	cycles32 [2][16]int
+	prefetch prefetch
 }
 
+var (
+	sramWaits = [4]int{4, 3, 2, 8}
+	romNWaits = [4]int{4, 3, 2, 8}
+	romSWaits = [3][2]int{{2, 1}, {4, 1}, {8, 1}} // WS0, WS1, WS2
+	// 16-bit and 32-bit access cycles of the internal regions
+	defaultWaits = [8][2]int{
+		0x0: {1, 1}, // BIOS
+		0x1: {1, 1},
+		0x2: {3, 6}, // EWRAM
+		0x3: {1, 1}, // IWRAM
+		0x4: {1, 1}, // I/O
+		0x5: {1, 2}, // PRAM
+		0x6: {1, 2}, // VRAM
+		0x7: {1, 1}, // OAM
+	}
+)
+
 func NewBus() *Bus {
 	return &Bus{}
 }
@@ -22,6 +46,62 @@ func NewBus() *Bus {
 func (bus *Bus) Setup(ppu *ppu.PPU, ioReg *ioreg.IOReg) {
 	bus.PPU = ppu
 	bus.IOReg = ioReg
+	bus.UpdateWaitStates()
+}
+
+// UpdateWaitStates recomputes the access cycles from WAITCNT.
+func (bus *Bus) UpdateWaitStates() {
+	bus.waitcnt = bus.IOReg.WAITCNT
+	for region := 0; region < 16; region++ {
+		var n16, s16, n32, s32 int
+		switch {
+		case region < 0x8:
+			n16, s16 = defaultWaits[region][0], defaultWaits[region][0]
+			n32, s32 = defaultWaits[region][1], defaultWaits[region][1]
+		case region < 0xE: // ROM, 16-bit bus
+			ws := (region - 0x8) / 2
+			n16 = 1 + romNWaits[(bus.waitcnt>>(2+3*ws))&3]
+			s16 = 1 + romSWaits[ws][(bus.waitcnt>>(4+3*ws))&1]
+			n32, s32 = n16+s16, 2*s16
+		default: // SRAM
+			n16 = 1 + sramWaits[bus.waitcnt&3]
+			s16, n32, s32 = n16, n16, n16
+		}
+		bus.cycles16[0][region], bus.cycles16[1][region] = n16, s16
+		bus.cycles32[0][region], bus.cycles32[1][region] = n32, s32
+	}
+	bus.prefetch.enabled = bus.waitcnt&(1<<14) != 0
+	if !bus.prefetch.enabled {
+		bus.PrefetchStop()
+	}
+}
+
+// AccessCycles returns the cycles of an access of width bytes.
+func (bus *Bus) AccessCycles(addr uint32, width int, seq bool) int {
+	region := addr >> 24
+	if region >= 16 {
+		return 1
+	}
+	s := 0
+	if seq {
+		s = 1
+	}
+	cycles := bus.cycles16[s][region]
+	if width == 4 {
+		cycles = bus.cycles32[s][region]
+	}
+	// Video memory waits one more cycle while the PPU is using it.
+	if 0x5 <= region && region <= 0x7 && bus.PPU.IsDrawing() {
+		cycles++
+	}
+	return cycles
+}
+
+func (bus *Bus) commit() {
+	bus.IOReg.Commit()
+	if bus.IOReg.WAITCNT != bus.waitcnt {
+		bus.UpdateWaitStates()
+	}
 }
 
 func (bus *Bus) LoadBIOS(data []byte) {
@@ -45,6 +125,11 @@ func (bus *Bus) write8(addr uint32, val byte) {
 		bus.PPU.VRAM[offset] = val
 	} else if 0x7000000 <= addr && addr < 0x8000000 {
 		bus.PPU.OAM[(addr-0x7000000)&0x3FF] = val
+		bus.PPU.InvalidateOAM()
+	} else if gamepak.IsGPIOAddr(addr) && bus.GamePak.GPIO != nil {
+		bus.GamePak.GPIO.Write8(addr-0x80000C4, val)
+	} else if bus.GamePak.IsEEPROMAddr(addr) {
+		bus.GamePak.Backup.Write8(addr-0xD000000, val)
 	} else if 0xE000000 <= addr && addr < 0xE010000 {
 		bus.GamePak.Backup.Write8(addr-0xE000000, val)
 	}
@@ -73,7 +158,7 @@ func (bus *Bus) Write8(addr uint32, val byte) {
 		return
 	}
 	bus.write8(addr, val)
-	bus.IOReg.Commit()
+	bus.commit()
 }
 
 func (bus *Bus) Read8(addr uint32) byte {
@@ -95,6 +180,10 @@ func (bus *Bus) Read8(addr uint32) byte {
 		return bus.PPU.VRAM[offset]
 	} else if 0x7000000 <= addr && addr < 0x8000000 {
 		return bus.PPU.OAM[(addr-0x7000000)&0x3FF]
+	} else if gamepak.IsGPIOAddr(addr) && bus.GamePak.GPIO != nil && bus.GamePak.GPIO.Readable() {
+		return bus.GamePak.GPIO.Read8(addr - 0x80000C4)
+	} else if bus.GamePak.IsEEPROMAddr(addr) {
+		return bus.GamePak.Backup.Read8(addr - 0xD000000)
 	} else if 0x8000000 <= addr && addr < 0xE000000 {
 		return bus.GamePak.ROM[(addr-0x8000000)&0x1FFFFFF]
 	} else if 0xE000000 <= addr && addr < 0xE010000 {
@@ -106,7 +195,7 @@ func (bus *Bus) Read8(addr uint32) byte {
 func (bus *Bus) Write16(addr uint32, val uint16) {
 	bus.write8(addr, byte(val&0xFF))
 	bus.write8(addr+1, byte((val>>8)&0xFF))
-	bus.IOReg.Commit()
+	bus.commit()
 }
 
 func (bus *Bus) Read16(addr uint32) uint16 {
@@ -120,7 +209,7 @@ func (bus *Bus) Write32(addr uint32, val uint32) {
 	bus.write8(addr+1, byte((val>>8)&0xFF))
 	bus.write8(addr+2, byte((val>>16)&0xFF))
 	bus.write8(addr+3, byte((val>>24)&0xFF))
-	bus.IOReg.Commit()
+	bus.commit()
 }
 
 func (bus *Bus) Read32(addr uint32) uint32 {
@@ -128,3 +217,30 @@ func (bus *Bus) Read32(addr uint32) uint32 {
 	high := uint32(bus.Read16(addr + 2))
 	return (high << 16) | low
 }
+
+// ObserveDMA lets the EEPROM detect its address width from the length of
+// the DMA transfer that writes a request into it. A transfer that touches
+// the Game Pak also flushes the prefetch buffer.
+func (bus *Bus) ObserveDMA(src uint32, dst uint32, wordCount int) {
+	if IsROMAddr(src) || IsROMAddr(dst) {
+		bus.PrefetchStop()
+	}
+	if bus.GamePak == nil || !bus.GamePak.IsEEPROMAddr(dst) {
+		return
+	}
+	if eeprom, ok := bus.GamePak.Backup.(*gamepak.EEPROM); ok {
+		eeprom.DetectSize(wordCount)
+	}
+}
+
+func (bus *Bus) SaveState(w *state.Writer) {
+	w.Write(bus.EWRAM[:])
+	w.Write(bus.IWRAM[:])
+	bus.prefetch.saveState(w)
+}
+
+func (bus *Bus) LoadState(r *state.Reader) {
+	r.Read(bus.EWRAM[:])
+	r.Read(bus.IWRAM[:])
+	bus.prefetch.loadState(r)
+}
@@ -0,0 +1,96 @@
+package bus
+
+import "github.com/Div9851/gba-go/internal/state"
+
+// The Game Pak prefetch buffer (WAITCNT bit 14) keeps reading the ROM
+// halfwords that follow the last opcode fetch while the CPU is busy with
+// something else, up to 8 halfwords. An opcode fetch served from the buffer
+// takes a single cycle; one that catches a halfword still being read waits
+// only for the rest of it.
+
+const prefetchSize = 8
+
+type prefetch struct {
+	enabled bool
+	active  bool
+	head    uint32 // address of the oldest buffered halfword
+	count   int    // halfwords in the buffer
+	cycles  int    // cycles spent on the halfword being read
+}
+
+// IsROMAddr reports whether addr is in one of the Game Pak ROM regions
+// (wait states 0-2), where the prefetch buffer operates.
+func IsROMAddr(addr uint32) bool {
+	return 0x8000000 <= addr && addr < 0xE000000
+}
+
+// FetchCycles returns the cycles of an opcode fetch of width bytes.
+func (bus *Bus) FetchCycles(addr uint32, width int, seq bool) int {
+	pf := &bus.prefetch
+	if !pf.enabled || !IsROMAddr(addr) {
+		return bus.AccessCycles(addr, width, seq)
+	}
+	if pf.active && addr == pf.head {
+		halfwords := width / 2
+		cycles := 0
+		s16 := bus.cycles16[1][addr>>24]
+		for pf.count < halfwords {
+			cycles += s16 - pf.cycles
+			pf.cycles = 0
+			pf.count++
+		}
+		if cycles == 0 {
+			cycles = 1
+		}
+		pf.count -= halfwords
+		pf.head += uint32(width)
+		return cycles
+	}
+	// Miss: the fetch goes to the ROM and prefetching restarts after it.
+	cycles := bus.AccessCycles(addr, width, seq)
+	pf.active = true
+	pf.head = addr + uint32(width)
+	pf.count = 0
+	pf.cycles = 0
+	return cycles
+}
+
+// PrefetchIdle lets the prefetch unit use cycles in which the CPU does not
+// need the Game Pak bus.
+func (bus *Bus) PrefetchIdle(cycles int) {
+	pf := &bus.prefetch
+	if !pf.active || cycles <= 0 {
+		return
+	}
+	s16 := bus.cycles16[1][pf.head>>24]
+	pf.cycles += cycles
+	for pf.count < prefetchSize && pf.cycles >= s16 {
+		pf.cycles -= s16
+		pf.count++
+	}
+	if pf.count == prefetchSize {
+		pf.cycles = 0
+	}
+}
+
+// PrefetchStop empties the buffer. Any other access to the Game Pak takes
+// the bus away from the prefetch unit.
+func (bus *Bus) PrefetchStop() {
+	bus.prefetch.active = false
+	bus.prefetch.count = 0
+	bus.prefetch.cycles = 0
+}
+
+func (pf *prefetch) saveState(w *state.Writer) {
+	w.Write(pf.active)
+	w.Write(pf.head)
+	w.WriteInt(pf.count)
+	w.WriteInt(pf.cycles)
+}
+
+func (pf *prefetch) loadState(r *state.Reader) {
+	r.Read(&pf.active)
+	r.Read(&pf.head)
+	r.ReadInt(&pf.count)
+	r.ReadInt(&pf.cycles)
+}
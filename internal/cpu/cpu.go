@@ -5,6 +5,7 @@ import (
 
 	"github.com/Div9851/gba-go/internal/bus"
 	"github.com/Div9851/gba-go/internal/irq"
+	"github.com/Div9851/gba-go/internal/state"
 )
 
 const (
@@ -48,22 +49,52 @@ type CPU struct {
 	IRQ                 *irq.IRQ
 	Pipeline            [2]uint32
 	ShouldResetPipeline bool
+	// HLE makes SWI calls run natively instead of jumping into the BIOS.
+	HLE        bool
+	hleWaiting bool
+	hleMasked  bool      // CPSR.I of the caller, restored when IntrWait returns
+	hleLogged  [256]bool // unemulated SWIs already reported
+
+	// Timing of the instruction being executed
+	cycles       int
+	dataAccesses int
+	nextDataAddr uint32
+	romCycles    int // cycles of data accesses to the Game Pak
+	loaded       bool
 }
 
 func NewCPU(bus *bus.Bus, irq *irq.IRQ) *CPU {
-	reg := [16]uint32{}
-	reg[13] = 0x03007F00
-	reg[15] = 0x08000000
-	bankedReg := [5][16]uint32{}
-	bankedReg[1][13] = 0x03007FA0
-	bankedReg[2][13] = 0x03007FE0
-	return &CPU{
-		reg:       reg,
-		bankedReg: bankedReg,
-		CPSR:      0x1F,
-		Bus:       bus,
-		IRQ:       irq,
-	}
+	cpu := &CPU{
+		Bus: bus,
+		IRQ: irq,
+	}
+	cpu.DirectBoot()
+	return cpu
+}
+
+// Reset puts the CPU in the state after the reset exception, so execution
+// starts at the BIOS entry point.
+func (cpu *CPU) Reset() {
+	cpu.reg = [16]uint32{}
+	cpu.bankedReg = [5][16]uint32{}
+	cpu.SPSR = [5]uint32{}
+	cpu.CPSR = BitI | BitF | ModeSVC
+	cpu.hleWaiting = false
+	cpu.WriteReg(15, 0x00000000)
+}
+
+// DirectBoot puts the CPU in the state the BIOS leaves behind when it jumps
+// to the cartridge entry point.
+func (cpu *CPU) DirectBoot() {
+	cpu.reg = [16]uint32{}
+	cpu.bankedReg = [5][16]uint32{}
+	cpu.SPSR = [5]uint32{}
+	cpu.reg[13] = 0x03007F00
+	cpu.bankedReg[1][13] = 0x03007FA0 // IRQ
+	cpu.bankedReg[2][13] = 0x03007FE0 // SVC
+	cpu.CPSR = ModeSYS
+	cpu.hleWaiting = false
+	cpu.WriteReg(15, 0x08000000)
 }
 
 func (cpu *CPU) ReadReg(index int) uint32 {
@@ -289,10 +320,12 @@ func (cpu *CPU) ResetPipeline() {
 	cpu.ShouldResetPipeline = false
 	pc := cpu.ReadReg(15)
 	if cpu.IsThumb() {
+		cpu.cycles += cpu.Bus.FetchCycles(pc, 2, false) + cpu.Bus.FetchCycles(pc+2, 2, true)
 		cpu.Pipeline[0] = uint32(cpu.Bus.Read16(pc + 2))
 		cpu.Pipeline[1] = uint32(cpu.Bus.Read16(pc))
 		cpu.reg[15] = pc + 4
 	} else {
+		cpu.cycles += cpu.Bus.FetchCycles(pc, 4, false) + cpu.Bus.FetchCycles(pc+4, 4, true)
 		cpu.Pipeline[0] = cpu.Bus.Read32(pc + 4)
 		cpu.Pipeline[1] = cpu.Bus.Read32(pc)
 		cpu.reg[15] = pc + 8
@@ -301,22 +334,49 @@ func (cpu *CPU) ResetPipeline() {
 
 func (cpu *CPU) AdvancePipeline() {
 	pc := cpu.ReadReg(15)
+	// The fetch after a data access is non-sequential.
+	seq := cpu.dataAccesses == 0
 	if cpu.IsThumb() {
+		cpu.cycles += cpu.Bus.FetchCycles(pc, 2, seq)
 		cpu.Pipeline[1] = cpu.Pipeline[0]
 		cpu.Pipeline[0] = uint32(cpu.Bus.Read16(pc))
 		cpu.reg[15] = pc + 2
 	} else {
+		cpu.cycles += cpu.Bus.FetchCycles(pc, 4, seq)
 		cpu.Pipeline[1] = cpu.Pipeline[0]
 		cpu.Pipeline[0] = cpu.Bus.Read32(pc)
 		cpu.reg[15] = pc + 4
 	}
 }
 
-func (cpu *CPU) Step() {
+// flushPipeline refills the pipeline after a branch. The prefetch that was
+// in flight at the old PC is discarded but still costs its cycles.
+func (cpu *CPU) flushPipeline(fetchAddr uint32, fetchWidth int) {
+	cpu.cycles += cpu.Bus.FetchCycles(fetchAddr, fetchWidth, cpu.dataAccesses == 0)
+	cpu.ResetPipeline()
+}
+
+// Step executes one instruction, or enters an interrupt, and returns the
+// cycles it took. While halted nothing runs and it returns 0.
+func (cpu *CPU) Step() int {
+	if !cpu.IRQ.Wake() {
+		return 0
+	}
+	cpu.cycles = 0
+	cpu.dataAccesses = 0
+	cpu.romCycles = 0
+	cpu.loaded = false
+
+	fetchAddr := cpu.reg[15]
+	fetchWidth := 4
+	if cpu.IsThumb() {
+		fetchWidth = 2
+	}
+
 	if (cpu.CPSR&BitI) == 0 && (cpu.IRQ.IME&1) != 0 && (cpu.IRQ.IF&cpu.IRQ.IE) != 0 {
 		cpu.HandleException(ExceptNormalInterrupt)
-		cpu.ResetPipeline()
-		return
+		cpu.flushPipeline(fetchAddr, fetchWidth)
+		return cpu.cycles
 	}
 
 	opcode := cpu.Pipeline[1]
@@ -327,11 +387,17 @@ func (cpu *CPU) Step() {
 		cpu.ExecuteARM(opcode)
 	}
 
+	if cpu.loaded {
+		cpu.cycles++ // the loaded value is written back to the register
+	}
+	// The Game Pak prefetch runs while the instruction keeps off its bus.
+	cpu.Bus.PrefetchIdle(cpu.cycles - cpu.romCycles)
 	if cpu.ShouldResetPipeline {
-		cpu.ResetPipeline()
+		cpu.flushPipeline(fetchAddr, fetchWidth)
 	} else {
 		cpu.AdvancePipeline()
 	}
+	return cpu.cycles
 }
 
 func IsBranchExchange(opcode uint32) bool {
@@ -515,10 +581,10 @@ func (cpu *CPU) executeBlockDataTransfer(opcode uint32) {
 			}
 		}
 		if L {
-			val := cpu.Bus.Read32(addr)
+			val := cpu.read32(addr)
 			cpu.WriteReg(15, val)
 		} else {
-			cpu.Bus.Write32(addr, cpu.ReadReg(15)+4)
+			cpu.write32(addr, cpu.ReadReg(15)+4)
 		}
 		if W {
 			if U {
@@ -563,7 +629,7 @@ func (cpu *CPU) executeBlockDataTransfer(opcode uint32) {
 	for i := range 16 {
 		if (Rlist & (1 << i)) != 0 {
 			if L { // load
-				val := cpu.Bus.Read32(addr)
+				val := cpu.read32(addr)
 				if S {
 					cpu.WriteUserReg(i, val)
 					if i == 15 {
@@ -582,7 +648,7 @@ func (cpu *CPU) executeBlockDataTransfer(opcode uint32) {
 				if i == 15 {
 					val += 4
 				}
-				cpu.Bus.Write32(addr, val)
+				cpu.write32(addr, val)
 			}
 			addr += 4
 		}
@@ -612,7 +678,10 @@ func (cpu *CPU) executeBranchAndBranchWithLink(opcode uint32) {
 	cpu.WriteReg(15, pc+uint32(int32(offset)))
 }
 
-func (cpu *CPU) executeSoftwareInterrupt() {
+func (cpu *CPU) executeSoftwareInterrupt(opcode uint32) {
+	if cpu.HLE && cpu.executeHLESoftwareInterrupt(byte(opcode>>16)) {
+		return
+	}
 	cpu.HandleException(ExceptSoftwareInterrupt)
 }
 
@@ -665,18 +734,18 @@ func (cpu *CPU) executeSingleDataTransfer(opcode uint32) {
 
 	if L { // load
 		if B {
-			val := cpu.Bus.Read8(addr)
+			val := cpu.read8(addr)
 			cpu.WriteReg(Rd, uint32(val))
 		} else {
-			val := cpu.Bus.Read32(addr & 0xFFFFFFFC)
+			val := cpu.read32(addr & 0xFFFFFFFC)
 			val, _ = ROR(val, uint(addr&0x3)*8)
 			cpu.WriteReg(Rd, val)
 		}
 	} else { // store
 		if B {
-			cpu.Bus.Write8(addr, byte(RdVal&0xFF))
+			cpu.write8(addr, byte(RdVal&0xFF))
 		} else {
-			cpu.Bus.Write32(addr&0xFFFFFFFC, RdVal)
+			cpu.write32(addr&0xFFFFFFFC, RdVal)
 		}
 	}
 }
@@ -690,12 +759,12 @@ func (cpu *CPU) executeSingleDataSwap(opcode uint32) {
 	RmVal := cpu.ReadReg(Rm)
 	var memVal uint32
 	if B {
-		memVal = uint32(cpu.Bus.Read8(addr))
-		cpu.Bus.Write8(addr, byte(RmVal&0xFF))
+		memVal = uint32(cpu.read8(addr))
+		cpu.write8(addr, byte(RmVal&0xFF))
 	} else {
-		memVal = cpu.Bus.Read32(addr & 0xFFFFFFFC)
+		memVal = cpu.read32(addr & 0xFFFFFFFC)
 		memVal, _ = ROR(memVal, uint(addr&0x3)*8)
-		cpu.Bus.Write32(addr&0xFFFFFFFC, RmVal)
+		cpu.write32(addr&0xFFFFFFFC, RmVal)
 	}
 	cpu.WriteReg(Rd, memVal)
 }
@@ -711,6 +780,14 @@ func (cpu *CPU) executeMultiply(opcode uint32) {
 	var flags uint32
 	var flagsMask uint32 = BitN | BitZ
 
+	cpu.cycles += multiplyCycles(cpu.ReadReg(Rs), op != 0x4 && op != 0x5)
+	switch op {
+	case 0x1, 0x4, 0x6: // MLA, UMULL, SMULL
+		cpu.cycles += 1
+	case 0x5, 0x7: // UMLAL, SMLAL
+		cpu.cycles += 2
+	}
+
 	switch op {
 	case 0x0: // MUL
 		RmVal := cpu.ReadReg(Rm)
@@ -848,17 +925,17 @@ func (cpu *CPU) executeHalfwordDataTransfer(opcode uint32) {
 		var val uint32
 		switch op {
 		case 0x1: // LDRH
-			val = uint32(cpu.Bus.Read16(addr & 0xFFFFFFFE))
+			val = uint32(cpu.read16(addr & 0xFFFFFFFE))
 			if (addr & 0x1) != 0 {
 				val, _ = ROR(val, 8)
 			}
 		case 0x2: // LDRSB
-			val = uint32(cpu.Bus.Read8(addr))
+			val = uint32(cpu.read8(addr))
 			if (val & 0x80) != 0 {
 				val |= 0xFFFFFF00
 			}
 		case 0x3: // LDRSH
-			val = uint32(cpu.Bus.Read16(addr & 0xFFFFFFFE))
+			val = uint32(cpu.read16(addr & 0xFFFFFFFE))
 			if (addr & 0x1) != 0 {
 				val >>= 8
 				if (val & 0x80) != 0 {
@@ -874,13 +951,13 @@ func (cpu *CPU) executeHalfwordDataTransfer(opcode uint32) {
 	} else { // store
 		switch op {
 		case 0x1: // STRH
-			cpu.Bus.Write16(addr&0xFFFFFFFE, uint16(RdVal&0xFFFF))
+			cpu.write16(addr&0xFFFFFFFE, uint16(RdVal&0xFFFF))
 		case 0x2: // LDRD
-			cpu.WriteReg(Rd, cpu.Bus.Read32(addr))
-			cpu.WriteReg(Rd+1, cpu.Bus.Read32(addr+4))
+			cpu.WriteReg(Rd, cpu.read32(addr))
+			cpu.WriteReg(Rd+1, cpu.read32(addr+4))
 		case 0x3: // STRD
-			cpu.Bus.Write32(addr, cpu.ReadReg(Rd))
-			cpu.Bus.Write32(addr+4, cpu.ReadReg(Rd+1))
+			cpu.write32(addr, cpu.ReadReg(Rd))
+			cpu.write32(addr+4, cpu.ReadReg(Rd+1))
 		}
 	}
 }
@@ -964,6 +1041,7 @@ func (cpu *CPU) executeDataProcessing(opcode uint32) {
 		if R { // register
 			Rs := int((opcode >> 8) & 0xF)
 			shiftAmount = uint(cpu.ReadReg(Rs))
+			cpu.cycles++
 		} else { // immediate
 			shiftAmount = uint((opcode >> 7) & 0x1F)
 		}
@@ -1146,7 +1224,7 @@ func (cpu *CPU) ExecuteARM(opcode uint32) {
 	case IsBranchAndBranchWithLink(opcode):
 		cpu.executeBranchAndBranchWithLink(opcode)
 	case IsSoftwareInterrupt(opcode):
-		cpu.executeSoftwareInterrupt()
+		cpu.executeSoftwareInterrupt(opcode)
 	case IsUndefined(opcode):
 		cpu.executeUndefined()
 	case IsSingleDataTransfer(opcode):
@@ -1283,7 +1361,10 @@ func IsThumbMoveShiftedRegister(opcode uint16) bool {
 
 }
 
-func (cpu *CPU) executeThumbSoftwareInterrupt() {
+func (cpu *CPU) executeThumbSoftwareInterrupt(opcode uint16) {
+	if cpu.HLE && cpu.executeHLESoftwareInterrupt(byte(opcode)) {
+		return
+	}
 	cpu.HandleException(ExceptSoftwareInterrupt)
 }
 
@@ -1352,9 +1433,9 @@ func (cpu *CPU) executeThumbMultipleLoadStore(opcode uint16) {
 
 	if Rlist == 0 {
 		if op == 0 {
-			cpu.Bus.Write32(addr, cpu.ReadReg(15)+2)
+			cpu.write32(addr, cpu.ReadReg(15)+2)
 		} else {
-			cpu.WriteReg(15, cpu.Bus.Read32(addr))
+			cpu.WriteReg(15, cpu.read32(addr))
 		}
 		RbVal := cpu.ReadReg(Rb)
 		cpu.WriteReg(Rb, RbVal+0x40)
@@ -1374,9 +1455,9 @@ func (cpu *CPU) executeThumbMultipleLoadStore(opcode uint16) {
 		if (Rlist & (1 << i)) != 0 {
 			switch op {
 			case 0x0: // STM
-				cpu.Bus.Write32(addr, cpu.ReadReg(i))
+				cpu.write32(addr, cpu.ReadReg(i))
 			case 0x1: // LDM
-				cpu.WriteReg(i, cpu.Bus.Read32(addr))
+				cpu.WriteReg(i, cpu.read32(addr))
 			}
 			addr += 4
 		}
@@ -1430,24 +1511,24 @@ func (cpu *CPU) executeThumbPushPopRegisters(opcode uint16) {
 		// PUSH LR
 		if PC_LR {
 			sp -= 4
-			cpu.Bus.Write32(sp, cpu.ReadReg(14))
+			cpu.write32(sp, cpu.ReadReg(14))
 		}
 		for i := 7; i >= 0; i-- {
 			if (Rlist & (1 << i)) != 0 {
 				sp -= 4
-				cpu.Bus.Write32(sp, cpu.ReadReg(i))
+				cpu.write32(sp, cpu.ReadReg(i))
 			}
 		}
 	case 0x1: // POP
 		for i := 0; i < 8; i++ {
 			if (Rlist & (1 << i)) != 0 {
-				cpu.WriteReg(i, cpu.Bus.Read32(sp))
+				cpu.WriteReg(i, cpu.read32(sp))
 				sp += 4
 			}
 		}
 		// POP PC
 		if PC_LR {
-			cpu.WriteReg(15, cpu.Bus.Read32(sp)&0xFFFFFFFE)
+			cpu.WriteReg(15, cpu.read32(sp)&0xFFFFFFFE)
 			sp += 4
 		}
 	}
@@ -1464,9 +1545,9 @@ func (cpu *CPU) executeThumbLoadStoreHalfword(opcode uint16) {
 
 	switch op {
 	case 0x0: // STRH
-		cpu.Bus.Write16(addr&0xFFFFFFFE, uint16(cpu.ReadReg(Rd)&0xFFFF))
+		cpu.write16(addr&0xFFFFFFFE, uint16(cpu.ReadReg(Rd)&0xFFFF))
 	case 0x1: // LDRH
-		val := uint32(cpu.Bus.Read16(addr & 0xFFFFFFFE))
+		val := uint32(cpu.read16(addr & 0xFFFFFFFE))
 		if (addr & 0x1) != 0 {
 			val, _ = ROR(val, 8)
 		}
@@ -1482,9 +1563,9 @@ func (cpu *CPU) executeThumbSPRelativeLoadStore(opcode uint16) {
 
 	switch op {
 	case 0x0: // STR
-		cpu.Bus.Write32(addr&0xFFFFFFFC, cpu.ReadReg(Rd))
+		cpu.write32(addr&0xFFFFFFFC, cpu.ReadReg(Rd))
 	case 0x1: // LDR
-		val := cpu.Bus.Read32(addr & 0xFFFFFFFC)
+		val := cpu.read32(addr & 0xFFFFFFFC)
 		val, _ = ROR(val, uint(addr&0x3)*8)
 		cpu.WriteReg(Rd, val)
 	}
@@ -1513,18 +1594,18 @@ func (cpu *CPU) executeThumbLoadStoreWithImmediateOffset(opcode uint16) {
 	switch op {
 	case 0x0: // STR
 		addr := RbVal + (nn << 2)
-		cpu.Bus.Write32(addr&0xFFFFFFFC, cpu.ReadReg(Rd))
+		cpu.write32(addr&0xFFFFFFFC, cpu.ReadReg(Rd))
 	case 0x1: // LDR
 		addr := RbVal + (nn << 2)
-		val := cpu.Bus.Read32(addr & 0xFFFFFFFC)
+		val := cpu.read32(addr & 0xFFFFFFFC)
 		val, _ = ROR(val, uint(addr&0x3)*8)
 		cpu.WriteReg(Rd, val)
 	case 0x2: // STRB
 		addr := RbVal + nn
-		cpu.Bus.Write8(addr, byte(cpu.ReadReg(Rd)&0xFF))
+		cpu.write8(addr, byte(cpu.ReadReg(Rd)&0xFF))
 	case 0x3: // LDRB
 		addr := RbVal + nn
-		cpu.WriteReg(Rd, uint32(cpu.Bus.Read8(addr)))
+		cpu.WriteReg(Rd, uint32(cpu.read8(addr)))
 	}
 }
 
@@ -1538,15 +1619,15 @@ func (cpu *CPU) executeThumbLoadStoreWithRegisterOffset(opcode uint16) {
 
 	switch op {
 	case 0x0: // STR
-		cpu.Bus.Write32(addr&0xFFFFFFFC, cpu.ReadReg(Rd))
+		cpu.write32(addr&0xFFFFFFFC, cpu.ReadReg(Rd))
 	case 0x1: // STRB
-		cpu.Bus.Write8(addr, byte(cpu.ReadReg(Rd)&0xFF))
+		cpu.write8(addr, byte(cpu.ReadReg(Rd)&0xFF))
 	case 0x2: // LDR
-		val := cpu.Bus.Read32(addr & 0xFFFFFFFC)
+		val := cpu.read32(addr & 0xFFFFFFFC)
 		val, _ = ROR(val, uint(addr&0x3)*8)
 		cpu.WriteReg(Rd, val)
 	case 0x3: // LDRB
-		cpu.WriteReg(Rd, uint32(cpu.Bus.Read8(addr)))
+		cpu.WriteReg(Rd, uint32(cpu.read8(addr)))
 	}
 }
 
@@ -1560,18 +1641,18 @@ func (cpu *CPU) executeThumbLoadStoreSignExtendedByteHalfword(opcode uint16) {
 
 	switch op {
 	case 0x0: // STRH
-		cpu.Bus.Write16(addr&0xFFFFFFFE, uint16(cpu.ReadReg(Rd)&0xFFFF))
+		cpu.write16(addr&0xFFFFFFFE, uint16(cpu.ReadReg(Rd)&0xFFFF))
 	case 0x1: // LDRSB
-		val := int32(int8(cpu.Bus.Read8(addr)))
+		val := int32(int8(cpu.read8(addr)))
 		cpu.WriteReg(Rd, uint32(val))
 	case 0x2: // LDRH
-		val := uint32(cpu.Bus.Read16(addr & 0xFFFFFFFE))
+		val := uint32(cpu.read16(addr & 0xFFFFFFFE))
 		if (addr & 0x1) != 0 {
 			val, _ = ROR(val, 8)
 		}
 		cpu.WriteReg(Rd, val)
 	case 0x3: // LDRSH
-		val := uint32(cpu.Bus.Read16(addr & 0xFFFFFFFE))
+		val := uint32(cpu.read16(addr & 0xFFFFFFFE))
 		if (addr & 0x1) != 0 {
 			val >>= 8
 			if (val & 0x80) != 0 {
@@ -1591,7 +1672,7 @@ func (cpu *CPU) executeThumbPCRelativeLoad(opcode uint16) {
 	nn := (uint32(opcode) & 0xFF) << 2
 
 	pc := cpu.ReadReg(15) & 0xFFFFFFFC
-	val := cpu.Bus.Read32(pc + nn)
+	val := cpu.read32(pc + nn)
 	cpu.WriteReg(Rd, val)
 }
 
@@ -1661,6 +1742,13 @@ func (cpu *CPU) executeThumbALUOperations(opcode uint16) {
 	RsVal := cpu.ReadReg(Rs)
 	RdVal := cpu.ReadReg(Rd)
 
+	switch op {
+	case 0x2, 0x3, 0x4, 0x7: // shift by register
+		cpu.cycles++
+	case 0xD: // MUL
+		cpu.cycles += multiplyCycles(RdVal, true)
+	}
+
 	switch op {
 	case 0x0: // AND
 		result := RdVal & RsVal
@@ -1857,7 +1945,7 @@ func (cpu *CPU) executeThumbMoveShiftedRegister(opcode uint16) {
 func (cpu *CPU) ExecuteThumb(opcode uint16) {
 	switch {
 	case IsThumbSoftwareInterrupt(opcode):
-		cpu.executeThumbSoftwareInterrupt()
+		cpu.executeThumbSoftwareInterrupt(opcode)
 	case IsThumbUnconditionalBranch(opcode):
 		cpu.executeThumbUnconditionalBranch(opcode)
 	case IsThumbConditionalBranch(opcode):
@@ -1896,3 +1984,25 @@ func (cpu *CPU) ExecuteThumb(opcode uint16) {
 		cpu.executeThumbMoveShiftedRegister(opcode)
 	}
 }
+
+func (cpu *CPU) SaveState(w *state.Writer) {
+	w.Write(cpu.reg[:])
+	w.Write(&cpu.bankedReg)
+	w.Write(cpu.CPSR)
+	w.Write(cpu.SPSR[:])
+	w.Write(cpu.Pipeline[:])
+	w.Write(cpu.ShouldResetPipeline)
+	w.Write(cpu.hleWaiting)
+	w.Write(cpu.hleMasked)
+}
+
+func (cpu *CPU) LoadState(r *state.Reader) {
+	r.Read(cpu.reg[:])
+	r.Read(&cpu.bankedReg)
+	r.Read(&cpu.CPSR)
+	r.Read(cpu.SPSR[:])
+	r.Read(cpu.Pipeline[:])
+	r.Read(&cpu.ShouldResetPipeline)
+	r.Read(&cpu.hleWaiting)
+	r.Read(&cpu.hleMasked)
+}
@@ -0,0 +1,576 @@
+package cpu
+
+import (
+	"encoding/binary"
+	"log"
+	"math"
+)
+
+const (
+	// Interrupt flags acknowledged by the game's IRQ handler for IntrWait
+	// (the mirror at 0x3FFFFF8).
+	biosIF = 0x3007FF8
+)
+
+// HLEBIOS returns a BIOS image that only contains the IRQ vector stub.
+// SWI calls are intercepted by the CPU when HLE is set.
+func HLEBIOS() []byte {
+	image := make([]byte, 0x4000)
+	put := func(addr uint32, opcode uint32) {
+		binary.LittleEndian.PutUint32(image[addr:], opcode)
+	}
+	put(0x08, 0xE1B0F00E) // movs pc, lr
+	put(0x18, 0xEA000042) // b 0x128
+	// IRQ handler
+	put(0x128, 0xE92D500F) // stmfd sp!, {r0-r3, r12, lr}
+	put(0x12C, 0xE3A00301) // mov r0, #0x4000000
+	put(0x130, 0xE28FE000) // add lr, pc, #0
+	put(0x134, 0xE510F004) // ldr pc, [r0, #-4]
+	put(0x138, 0xE8BD500F) // ldmfd sp!, {r0-r3, r12, lr}
+	put(0x13C, 0xE25EF004) // subs pc, lr, #4
+	return image
+}
+
+// executeHLESoftwareInterrupt runs the BIOS function natively. It returns
+// false for functions that are not emulated, which then go through the
+// exception vector and return without doing anything.
+func (cpu *CPU) executeHLESoftwareInterrupt(comment byte) bool {
+	switch comment {
+	case 0x00:
+		cpu.hleSoftReset()
+	case 0x01:
+		cpu.RegisterRamReset(cpu.ReadReg(0))
+	case 0x02:
+		cpu.IRQ.Halted = true
+	case 0x03:
+		cpu.IRQ.Stopped = true
+	case 0x04:
+		cpu.hleIntrWait(cpu.ReadReg(0) != 0, uint16(cpu.ReadReg(1)))
+	case 0x05:
+		cpu.hleIntrWait(true, 1)
+	case 0x06:
+		cpu.hleDiv(int32(cpu.ReadReg(0)), int32(cpu.ReadReg(1)))
+	case 0x07:
+		cpu.hleDiv(int32(cpu.ReadReg(1)), int32(cpu.ReadReg(0)))
+	case 0x08:
+		cpu.WriteReg(0, uint32(isqrt(cpu.ReadReg(0))))
+	case 0x09:
+		cpu.WriteReg(0, uint32(arcTan(int32(int16(cpu.ReadReg(0))))))
+	case 0x0A:
+		cpu.WriteReg(0, uint32(arcTan2(int32(int16(cpu.ReadReg(0))), int32(int16(cpu.ReadReg(1))))))
+	case 0x0B:
+		cpu.hleCpuSet()
+	case 0x0C:
+		cpu.hleCpuFastSet()
+	case 0x0D:
+		cpu.WriteReg(0, 0xBAAE187F) // GetBiosChecksum
+	case 0x0E:
+		cpu.hleBgAffineSet()
+	case 0x0F:
+		cpu.hleObjAffineSet()
+	case 0x11, 0x12:
+		cpu.writeOutput(cpu.ReadReg(1), cpu.decompressLZ77(cpu.ReadReg(0)))
+	case 0x10:
+		cpu.hleBitUnPack()
+	case 0x13:
+		cpu.writeOutput(cpu.ReadReg(1), cpu.decompressHuffman(cpu.ReadReg(0)))
+	case 0x14, 0x15:
+		cpu.writeOutput(cpu.ReadReg(1), cpu.decompressRL(cpu.ReadReg(0)))
+	case 0x16, 0x17:
+		cpu.writeOutput(cpu.ReadReg(1), cpu.diff8bitUnFilter(cpu.ReadReg(0)))
+	case 0x18:
+		cpu.writeOutput(cpu.ReadReg(1), cpu.diff16bitUnFilter(cpu.ReadReg(0)))
+	case 0x19:
+		cpu.hleSoundBias()
+	case 0x1F:
+		cpu.hleMidiKey2Freq()
+	default:
+		if !cpu.hleLogged[comment] {
+			cpu.hleLogged[comment] = true
+			log.Printf("cpu: SWI %02Xh is not emulated by the HLE BIOS", comment)
+		}
+		return false
+	}
+	return true
+}
+
+// hleSoftReset clears the top of IWRAM and restarts at the cartridge, or at
+// EWRAM if the byte at 0x3007FFA is nonzero.
+func (cpu *CPU) hleSoftReset() {
+	entry := uint32(0x8000000)
+	if cpu.Bus.Read8(0x3007FFA) != 0 {
+		entry = 0x2000000
+	}
+	for addr := uint32(0x3007E00); addr < 0x3008000; addr += 4 {
+		cpu.Bus.Write32(addr, 0)
+	}
+	cpu.DirectBoot()
+	cpu.WriteReg(15, entry)
+}
+
+// repeatSoftwareInterrupt makes the CPU execute the current SWI again, so
+// waiting functions keep polling while interrupts are serviced in between.
+func (cpu *CPU) repeatSoftwareInterrupt() {
+	if cpu.IsThumb() {
+		cpu.WriteReg(15, cpu.ReadReg(15)-4)
+	} else {
+		cpu.WriteReg(15, cpu.ReadReg(15)-8)
+	}
+}
+
+// hleIntrWait enables IRQs in the CPSR for the wait, as the BIOS does, so
+// the flags can be raised even when the caller has them masked.
+func (cpu *CPU) hleIntrWait(discard bool, flags uint16) {
+	cpu.IRQ.IME = 1
+	if !cpu.hleWaiting {
+		cpu.hleMasked = (cpu.CPSR & BitI) != 0
+		if discard {
+			cpu.Bus.Write16(biosIF, cpu.Bus.Read16(biosIF) & ^flags)
+		}
+	}
+	if raised := cpu.Bus.Read16(biosIF) & flags; raised != 0 {
+		cpu.Bus.Write16(biosIF, cpu.Bus.Read16(biosIF) & ^raised)
+		cpu.hleWaiting = false
+		if cpu.hleMasked {
+			cpu.CPSR |= BitI
+		}
+		return
+	}
+	cpu.hleWaiting = true
+	cpu.CPSR &^= BitI
+	cpu.IRQ.Halted = true
+	cpu.repeatSoftwareInterrupt()
+}
+
+func (cpu *CPU) hleDiv(num, denom int32) {
+	if denom == 0 {
+		// The real BIOS hangs here.
+		if num < 0 {
+			cpu.WriteReg(0, 0xFFFFFFFF)
+		} else {
+			cpu.WriteReg(0, 1)
+		}
+		cpu.WriteReg(1, uint32(num))
+		cpu.WriteReg(3, 1)
+		return
+	}
+	if num == math.MinInt32 && denom == -1 {
+		cpu.WriteReg(0, uint32(num))
+		cpu.WriteReg(1, 0)
+		cpu.WriteReg(3, uint32(num))
+		return
+	}
+	quot := num / denom
+	abs := quot
+	if abs < 0 {
+		abs = -abs
+	}
+	cpu.WriteReg(0, uint32(quot))
+	cpu.WriteReg(1, uint32(num%denom))
+	cpu.WriteReg(3, uint32(abs))
+}
+
+func isqrt(x uint32) uint16 {
+	res := uint32(math.Sqrt(float64(x)))
+	for res*res > x {
+		res--
+	}
+	for (res+1)*(res+1) <= x && res < 0xFFFF {
+		res++
+	}
+	return uint16(res)
+}
+
+// arcTan uses the BIOS polynomial. The argument is a 1.14 fixed point
+// tangent in -1..1.
+func arcTan(i int32) uint16 {
+	a := -((i * i) >> 14)
+	b := ((0xA9 * a) >> 14) + 0x390
+	b = ((b * a) >> 14) + 0x91C
+	b = ((b * a) >> 14) + 0xFB6
+	b = ((b * a) >> 14) + 0x16AA
+	b = ((b * a) >> 14) + 0x2081
+	b = ((b * a) >> 14) + 0x3651
+	b = ((b * a) >> 14) + 0xA2F9
+	return uint16((i * b) >> 16)
+}
+
+// arcTan2 returns the angle of (x, y) where 0x10000 is a full turn.
+func arcTan2(x, y int32) uint16 {
+	if y == 0 {
+		if x >= 0 {
+			return 0
+		}
+		return 0x8000
+	}
+	if x == 0 {
+		if y >= 0 {
+			return 0x4000
+		}
+		return 0xC000
+	}
+	if y >= 0 {
+		if x >= 0 {
+			if x >= y {
+				return arcTan((y << 14) / x)
+			}
+		} else if -x >= y {
+			return arcTan((y<<14)/x) + 0x8000
+		}
+		return 0x4000 - arcTan((x<<14)/y)
+	}
+	if x <= 0 {
+		if -x > -y {
+			return arcTan((y<<14)/x) + 0x8000
+		}
+	} else if x >= -y {
+		return arcTan((y << 14) / x) // negative angles wrap around
+	}
+	return 0xC000 - arcTan((x<<14)/y)
+}
+
+func (cpu *CPU) hleCpuSet() {
+	src := cpu.ReadReg(0)
+	dst := cpu.ReadReg(1)
+	cnt := cpu.ReadReg(2)
+	count := cnt & 0x1FFFFF
+	fill := (cnt & (1 << 24)) != 0
+	if (cnt & (1 << 26)) != 0 {
+		src &= 0xFFFFFFFC
+		dst &= 0xFFFFFFFC
+		value := cpu.Bus.Read32(src)
+		for i := uint32(0); i < count; i++ {
+			if !fill {
+				value = cpu.Bus.Read32(src)
+				src += 4
+			}
+			cpu.Bus.Write32(dst, value)
+			dst += 4
+		}
+		return
+	}
+	src &= 0xFFFFFFFE
+	dst &= 0xFFFFFFFE
+	value := cpu.Bus.Read16(src)
+	for i := uint32(0); i < count; i++ {
+		if !fill {
+			value = cpu.Bus.Read16(src)
+			src += 2
+		}
+		cpu.Bus.Write16(dst, value)
+		dst += 2
+	}
+}
+
+func (cpu *CPU) hleCpuFastSet() {
+	src := cpu.ReadReg(0) & 0xFFFFFFFC
+	dst := cpu.ReadReg(1) & 0xFFFFFFFC
+	cnt := cpu.ReadReg(2)
+	count := ((cnt & 0x1FFFFF) + 7) & ^uint32(7) // in units of 8 words
+	fill := (cnt & (1 << 24)) != 0
+	value := cpu.Bus.Read32(src)
+	for i := uint32(0); i < count; i++ {
+		if !fill {
+			value = cpu.Bus.Read32(src)
+			src += 4
+		}
+		cpu.Bus.Write32(dst, value)
+		dst += 4
+	}
+}
+
+// hleBitUnPack widens units of 1-8 bits to 1-32 bits. The offset in the
+// info block is added to nonzero units, or to all of them with bit 31 set.
+func (cpu *CPU) hleBitUnPack() {
+	src := cpu.ReadReg(0)
+	dst := cpu.ReadReg(1) & 0xFFFFFFFC
+	info := cpu.ReadReg(2)
+	length := uint32(cpu.Bus.Read16(info))
+	srcWidth := int(cpu.Bus.Read8(info + 2))
+	dstWidth := int(cpu.Bus.Read8(info + 3))
+	offset := cpu.Bus.Read32(info + 4)
+	zeroData := (offset & (1 << 31)) != 0
+	offset &= 0x7FFFFFFF
+	switch srcWidth {
+	case 1, 2, 4, 8:
+	default:
+		return
+	}
+	switch dstWidth {
+	case 1, 2, 4, 8, 16, 32:
+	default:
+		return
+	}
+
+	var out uint32
+	outBits := 0
+	for i := uint32(0); i < length; i++ {
+		b := uint32(cpu.Bus.Read8(src + i))
+		for bit := 0; bit < 8; bit += srcWidth {
+			unit := (b >> bit) & (1<<srcWidth - 1)
+			if unit != 0 || zeroData {
+				unit += offset
+			}
+			out |= unit << outBits
+			outBits += dstWidth
+			if outBits == 32 {
+				cpu.Bus.Write32(dst, out)
+				dst += 4
+				out, outBits = 0, 0
+			}
+		}
+	}
+}
+
+// hleMidiKey2Freq returns the sample rate of the WaveData at r0 played at
+// MIDI key r1 plus r2/256 semitones. Key 180 plays it at its own rate.
+func (cpu *CPU) hleMidiKey2Freq() {
+	freq := float64(cpu.Bus.Read32(cpu.ReadReg(0) + 4))
+	key := float64(cpu.ReadReg(1)&0xFF) + float64(cpu.ReadReg(2)&0xFF)/256
+	cpu.WriteReg(0, uint32(freq/math.Pow(2, (180-key)/12)))
+}
+
+func (cpu *CPU) hleBgAffineSet() {
+	src := cpu.ReadReg(0)
+	dst := cpu.ReadReg(1)
+	count := cpu.ReadReg(2)
+	for i := uint32(0); i < count; i++ {
+		ox := float64(int32(cpu.Bus.Read32(src))) / 256
+		oy := float64(int32(cpu.Bus.Read32(src+4))) / 256
+		cx := float64(int16(cpu.Bus.Read16(src + 8)))
+		cy := float64(int16(cpu.Bus.Read16(src + 10)))
+		sx := float64(int16(cpu.Bus.Read16(src+12))) / 256
+		sy := float64(int16(cpu.Bus.Read16(src+14))) / 256
+		theta := float64(cpu.Bus.Read16(src+16)>>8) / 128 * math.Pi
+		src += 20
+
+		sin, cos := math.Sincos(theta)
+		pa := cos * sx
+		pb := -sin * sx
+		pc := sin * sy
+		pd := cos * sy
+		x := ox - (pa*cx + pb*cy)
+		y := oy - (pc*cx + pd*cy)
+		cpu.Bus.Write16(dst, uint16(int16(pa*256)))
+		cpu.Bus.Write16(dst+2, uint16(int16(pb*256)))
+		cpu.Bus.Write16(dst+4, uint16(int16(pc*256)))
+		cpu.Bus.Write16(dst+6, uint16(int16(pd*256)))
+		cpu.Bus.Write32(dst+8, uint32(int32(x*256)))
+		cpu.Bus.Write32(dst+12, uint32(int32(y*256)))
+		dst += 16
+	}
+}
+
+func (cpu *CPU) hleObjAffineSet() {
+	src := cpu.ReadReg(0)
+	dst := cpu.ReadReg(1)
+	count := cpu.ReadReg(2)
+	stride := cpu.ReadReg(3)
+	for i := uint32(0); i < count; i++ {
+		sx := float64(int16(cpu.Bus.Read16(src))) / 256
+		sy := float64(int16(cpu.Bus.Read16(src+2))) / 256
+		theta := float64(cpu.Bus.Read16(src+4)>>8) / 128 * math.Pi
+		src += 8
+
+		sin, cos := math.Sincos(theta)
+		cpu.Bus.Write16(dst, uint16(int16(cos*sx*256)))
+		cpu.Bus.Write16(dst+stride, uint16(int16(-sin*sx*256)))
+		cpu.Bus.Write16(dst+stride*2, uint16(int16(sin*sy*256)))
+		cpu.Bus.Write16(dst+stride*3, uint16(int16(cos*sy*256)))
+		dst += stride * 4
+	}
+}
+
+// writeOutput stores decompressed data with halfword writes, which works
+// for both the WRAM and VRAM variants of the functions.
+func (cpu *CPU) writeOutput(dst uint32, data []byte) {
+	dst &= 0xFFFFFFFE
+	for i := 0; i < len(data); i += 2 {
+		value := uint16(data[i])
+		if i+1 < len(data) {
+			value |= uint16(data[i+1]) << 8
+		}
+		cpu.Bus.Write16(dst+uint32(i), value)
+	}
+}
+
+func (cpu *CPU) decompressLZ77(src uint32) []byte {
+	size := int(cpu.Bus.Read32(src) >> 8)
+	src += 4
+	out := make([]byte, 0, size)
+	for len(out) < size {
+		flags := cpu.Bus.Read8(src)
+		src++
+		for i := 7; i >= 0 && len(out) < size; i-- {
+			if (flags & (1 << i)) == 0 {
+				out = append(out, cpu.Bus.Read8(src))
+				src++
+				continue
+			}
+			b0 := cpu.Bus.Read8(src)
+			b1 := cpu.Bus.Read8(src + 1)
+			src += 2
+			length := int(b0>>4) + 3
+			disp := (int(b0&0xF)<<8 | int(b1)) + 1
+			for j := 0; j < length && len(out) < size; j++ {
+				pos := len(out) - disp
+				if pos < 0 {
+					out = append(out, 0)
+				} else {
+					out = append(out, out[pos])
+				}
+			}
+		}
+	}
+	return out
+}
+
+func (cpu *CPU) decompressRL(src uint32) []byte {
+	size := int(cpu.Bus.Read32(src) >> 8)
+	src += 4
+	out := make([]byte, 0, size)
+	for len(out) < size {
+		flag := cpu.Bus.Read8(src)
+		src++
+		if (flag & 0x80) != 0 {
+			length := int(flag&0x7F) + 3
+			value := cpu.Bus.Read8(src)
+			src++
+			for j := 0; j < length && len(out) < size; j++ {
+				out = append(out, value)
+			}
+		} else {
+			length := int(flag&0x7F) + 1
+			for j := 0; j < length && len(out) < size; j++ {
+				out = append(out, cpu.Bus.Read8(src))
+				src++
+			}
+		}
+	}
+	return out
+}
+
+func (cpu *CPU) decompressHuffman(src uint32) []byte {
+	header := cpu.Bus.Read32(src)
+	size := int(header >> 8)
+	bitSize := int(header & 0xF)
+	if bitSize != 4 && bitSize != 8 {
+		bitSize = 8
+	}
+	treeSize := (uint32(cpu.Bus.Read8(src+4)) + 1) * 2
+	treeBase := src + 5
+	stream := src + 4 + treeSize
+
+	out := make([]byte, 0, size)
+	nodeAddr := treeBase
+	node := cpu.Bus.Read8(nodeAddr)
+	var (
+		unit     byte
+		unitBits int
+	)
+	for len(out) < size {
+		word := cpu.Bus.Read32(stream)
+		stream += 4
+		for bit := 31; bit >= 0 && len(out) < size; bit-- {
+			b := (word >> bit) & 1
+			next := (nodeAddr & 0xFFFFFFFE) + uint32(node&0x3F)*2 + 2 + b
+			if (node & (0x80 >> b)) == 0 {
+				nodeAddr = next
+				node = cpu.Bus.Read8(nodeAddr)
+				continue
+			}
+			value := cpu.Bus.Read8(next)
+			if bitSize == 8 {
+				out = append(out, value)
+			} else {
+				unit |= (value & 0xF) << unitBits
+				unitBits += 4
+				if unitBits == 8 {
+					out = append(out, unit)
+					unit, unitBits = 0, 0
+				}
+			}
+			nodeAddr = treeBase
+			node = cpu.Bus.Read8(nodeAddr)
+		}
+	}
+	return out
+}
+
+// diff8bitUnFilter undoes the 8-bit delta filter: each byte is stored as
+// the difference from the previous one.
+func (cpu *CPU) diff8bitUnFilter(src uint32) []byte {
+	size := int(cpu.Bus.Read32(src) >> 8)
+	src += 4
+	out := make([]byte, size)
+	var value byte
+	for i := range out {
+		value += cpu.Bus.Read8(src + uint32(i))
+		out[i] = value
+	}
+	return out
+}
+
+func (cpu *CPU) diff16bitUnFilter(src uint32) []byte {
+	size := int(cpu.Bus.Read32(src)>>8) & ^1
+	src += 4
+	out := make([]byte, size)
+	var value uint16
+	for i := 0; i < size; i += 2 {
+		value += cpu.Bus.Read16(src + uint32(i))
+		binary.LittleEndian.PutUint16(out[i:], value)
+	}
+	return out
+}
+
+func (cpu *CPU) hleSoundBias() {
+	var level uint16
+	if cpu.ReadReg(0) != 0 {
+		level = 0x200
+	}
+	value := cpu.Bus.Read16(0x4000088)
+	cpu.Bus.Write16(0x4000088, (value & ^uint16(0x3FF))|level)
+}
+
+// RegisterRamReset clears the memory and I/O areas selected by flags, as
+// the BIOS function does.
+func (cpu *CPU) RegisterRamReset(flags uint32) {
+	clear := func(start, end uint32) {
+		for addr := start; addr < end; addr += 4 {
+			cpu.Bus.Write32(addr, 0)
+		}
+	}
+	if (flags & (1 << 0)) != 0 {
+		clear(0x2000000, 0x2040000)
+	}
+	if (flags & (1 << 1)) != 0 {
+		clear(0x3000000, 0x3007E00) // the top 0x200 bytes hold the stacks
+	}
+	if (flags & (1 << 2)) != 0 {
+		clear(0x5000000, 0x5000400)
+	}
+	if (flags & (1 << 3)) != 0 {
+		clear(0x6000000, 0x6018000)
+	}
+	if (flags & (1 << 4)) != 0 {
+		clear(0x7000000, 0x7000400)
+	}
+	if (flags & (1 << 5)) != 0 {
+		clear(0x4000120, 0x4000130)
+		cpu.Bus.Write16(0x4000134, 0x8000) // RCNT
+		clear(0x4000140, 0x4000160)
+	}
+	if (flags & (1 << 6)) != 0 {
+		clear(0x4000060, 0x40000A0) // FIFOs are left alone
+	}
+	if (flags & (1 << 7)) != 0 {
+		clear(0x4000000, 0x4000060)
+		cpu.Bus.Write16(0x4000020, 0x100)
+		cpu.Bus.Write16(0x4000026, 0x100)
+		cpu.Bus.Write16(0x4000030, 0x100)
+		cpu.Bus.Write16(0x4000036, 0x100)
+		clear(0x40000B0, 0x4000120)
+		clear(0x4000200, 0x4000210)
+	}
+	cpu.Bus.Write16(0x4000000, 0x80) // forced blank, whatever the flags
+}
@@ -0,0 +1,400 @@
+package cpu
+
+import (
+	"bytes"
+	"math"
+	"testing"
+
+	"github.com/Div9851/gba-go/internal/apu"
+	"github.com/Div9851/gba-go/internal/bus"
+	"github.com/Div9851/gba-go/internal/dma"
+	"github.com/Div9851/gba-go/internal/input"
+	"github.com/Div9851/gba-go/internal/ioreg"
+	"github.com/Div9851/gba-go/internal/irq"
+	"github.com/Div9851/gba-go/internal/ppu"
+	"github.com/Div9851/gba-go/internal/scheduler"
+	"github.com/Div9851/gba-go/internal/timer"
+)
+
+const testBuffer = 0x2000000 // EWRAM
+
+func newTestCPU(t *testing.T) *CPU {
+	t.Helper()
+	sched := scheduler.NewScheduler()
+	b := bus.NewBus()
+	irq := irq.NewIRQ()
+	cpu := NewCPU(b, irq)
+	dmaChannels := [4]*dma.Channel{}
+	for i := range dmaChannels {
+		dmaChannels[i] = dma.NewChannel(i, b, irq, sched)
+	}
+	ppu := ppu.NewPPU(irq, dmaChannels, sched)
+	apu := apu.NewAPU(dmaChannels, sched)
+	timers := [4]*timer.Timer{}
+	for i := range timers {
+		timers[i] = timer.NewTimer(i, irq, apu, sched)
+	}
+	b.Setup(ppu, ioreg.NewIOReg(irq, ppu, apu, dmaChannels, input.NewInput(irq), timers))
+	cpu.HLE = true
+	return cpu
+}
+
+// swi runs a BIOS function with r0-r3 set to regs.
+func (cpu *CPU) swi(t *testing.T, comment byte, regs ...uint32) {
+	t.Helper()
+	for i, value := range regs {
+		cpu.WriteReg(i, value)
+	}
+	if !cpu.executeHLESoftwareInterrupt(comment) {
+		t.Fatalf("SWI %02Xh is not emulated", comment)
+	}
+}
+
+func (cpu *CPU) writeBytes(addr uint32, data []byte) {
+	for i, b := range data {
+		cpu.Bus.Write8(addr+uint32(i), b)
+	}
+}
+
+func (cpu *CPU) readBytes(addr uint32, length int) []byte {
+	data := make([]byte, length)
+	for i := range data {
+		data[i] = cpu.Bus.Read8(addr + uint32(i))
+	}
+	return data
+}
+
+func TestDiv(t *testing.T) {
+	tests := []struct {
+		name       string
+		arm        bool // DivArm takes the operands swapped
+		num, denom int32
+		r0, r1, r3 uint32
+	}{
+		{"positive", false, 7, 2, 3, 1, 3},
+		{"negative numerator", false, -7, 2, 0xFFFFFFFD, 0xFFFFFFFF, 3},
+		{"negative denominator", false, 7, -2, 0xFFFFFFFD, 1, 3},
+		{"both negative", false, -7, -2, 3, 0xFFFFFFFF, 3},
+		{"DivArm", true, 100, 7, 14, 2, 14},
+		{"by zero", false, 5, 0, 1, 5, 1},
+		{"negative by zero", false, -5, 0, 0xFFFFFFFF, 0xFFFFFFFB, 1},
+		{"MinInt32 by -1", false, math.MinInt32, -1, 0x80000000, 0, 0x80000000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cpu := newTestCPU(t)
+			if tt.arm {
+				cpu.swi(t, 0x07, uint32(tt.denom), uint32(tt.num))
+			} else {
+				cpu.swi(t, 0x06, uint32(tt.num), uint32(tt.denom))
+			}
+			got := [3]uint32{cpu.ReadReg(0), cpu.ReadReg(1), cpu.ReadReg(3)}
+			if want := [3]uint32{tt.r0, tt.r1, tt.r3}; got != want {
+				t.Errorf("r0, r1, r3 = %08X, want %08X", got, want)
+			}
+		})
+	}
+}
+
+func TestSqrt(t *testing.T) {
+	tests := []struct {
+		x, want uint32
+	}{
+		{0, 0},
+		{1, 1},
+		{15, 3},
+		{16, 4},
+		{0x80000000, 46340},
+		{0xFFFFFFFF, 0xFFFF},
+	}
+	for _, tt := range tests {
+		cpu := newTestCPU(t)
+		cpu.swi(t, 0x08, tt.x)
+		if got := cpu.ReadReg(0); got != tt.want {
+			t.Errorf("Sqrt(%#x) = %d, want %d", tt.x, got, tt.want)
+		}
+	}
+}
+
+func TestArcTan(t *testing.T) {
+	tests := []struct {
+		tan  int32 // 1.14 fixed point
+		want uint32
+	}{
+		{0, 0},
+		{0x1000, 0x9FB},
+		{0x2000, 0x12E4},
+		{0x4000, 0x2000},
+		{-0x4000, 0xE000},
+	}
+	for _, tt := range tests {
+		cpu := newTestCPU(t)
+		cpu.swi(t, 0x09, uint32(tt.tan))
+		got := cpu.ReadReg(0)
+		if got != tt.want {
+			t.Errorf("ArcTan(%#x) = %#x, want %#x", tt.tan, got, tt.want)
+		}
+		// The polynomial stays within a few units of the exact angle.
+		exact := math.Atan(float64(tt.tan)/0x4000) / math.Pi * 0x8000
+		if diff := float64(int16(got)) - exact; math.Abs(diff) > 4 {
+			t.Errorf("ArcTan(%#x) = %#x is %.1f off", tt.tan, got, diff)
+		}
+	}
+}
+
+func TestArcTan2(t *testing.T) {
+	tests := []struct {
+		name string
+		x, y int32
+		want uint32
+	}{
+		{"positive x axis", 0x100, 0, 0x0000},
+		{"positive y axis", 0, 0x100, 0x4000},
+		{"negative x axis", -0x100, 0, 0x8000},
+		{"negative y axis", 0, -0x100, 0xC000},
+		{"quadrant 1", 0x100, 0x100, 0x2000},
+		{"quadrant 1 steep", 0x80, 0x100, 0x2D1C},
+		{"quadrant 2", -0x100, 0x80, 0x6D1C},
+		{"quadrant 3", -0x100, -0x80, 0x92E4},
+		{"quadrant 4", 0x100, -0x80, 0xED1C},
+		{"quadrant 4 diagonal", 0x100, -0x100, 0xE000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cpu := newTestCPU(t)
+			cpu.swi(t, 0x0A, uint32(tt.x), uint32(tt.y))
+			if got := cpu.ReadReg(0); got != tt.want {
+				t.Errorf("ArcTan2(%d, %d) = %#x, want %#x", tt.x, tt.y, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCpuSet(t *testing.T) {
+	src := []byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0A, 0x0B, 0x0C}
+	tests := []struct {
+		name    string
+		comment byte
+		cnt     uint32
+		want    []byte // at the destination, followed by an untouched 0xEE
+	}{
+		{"16-bit copy", 0x0B, 3, src[:6]},
+		{"16-bit fill", 0x0B, 2 | 1<<24, []byte{0x01, 0x02, 0x01, 0x02}},
+		{"32-bit copy", 0x0B, 2 | 1<<26, src[:8]},
+		{"32-bit fill", 0x0B, 2 | 1<<24 | 1<<26, []byte{0x01, 0x02, 0x03, 0x04, 0x01, 0x02, 0x03, 0x04}},
+		{"fast fill rounds up to 8 words", 0x0C, 3 | 1<<24, bytes.Repeat([]byte{0x01, 0x02, 0x03, 0x04}, 8)},
+		{"fast copy of 8 words", 0x0C, 8, append(append([]byte{}, src...), make([]byte, 20)...)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cpu := newTestCPU(t)
+			dst := uint32(testBuffer + 0x100)
+			cpu.writeBytes(testBuffer, src)
+			cpu.writeBytes(dst, bytes.Repeat([]byte{0xEE}, 0x40))
+			cpu.swi(t, tt.comment, testBuffer, dst, tt.cnt)
+			want := append(bytes.Clone(tt.want), 0xEE)
+			if got := cpu.readBytes(dst, len(want)); !bytes.Equal(got, want) {
+				t.Errorf("dst = % X, want % X", got, want)
+			}
+		})
+	}
+}
+
+func TestDecompress(t *testing.T) {
+	tests := []struct {
+		name    string
+		comment byte
+		data    []byte
+		want    []byte
+	}{
+		{
+			name:    "LZ77",
+			comment: 0x11,
+			data:    []byte{0x10, 0x09, 0x00, 0x00, 0x10, 'A', 'B', 'C', 0x30, 0x02},
+			want:    []byte("ABCABCABC"),
+		},
+		{
+			name:    "LZ77 VRAM",
+			comment: 0x12,
+			data:    []byte{0x10, 0x06, 0x00, 0x00, 0x20, 'x', 'y', 0x00, 0x01, 'z'},
+			want:    []byte("xyxyxz"),
+		},
+		{
+			name:    "RL",
+			comment: 0x14,
+			data:    []byte{0x30, 0x06, 0x00, 0x00, 0x82, 'A', 0x00, 'B'},
+			want:    []byte("AAAAAB"),
+		},
+		{
+			name:    "Huffman 8-bit",
+			comment: 0x13,
+			// Root with two leaves: bit 0 is 'a', bit 1 is 'b'.
+			data: []byte{0x28, 0x04, 0x00, 0x00, 0x01, 0xC0, 'a', 'b', 0x00, 0x00, 0x00, 0x60},
+			want: []byte("abba"),
+		},
+		{
+			name:    "Huffman 4-bit",
+			comment: 0x13,
+			// Leaves 1 and 2; units are packed low nibble first.
+			data: []byte{0x24, 0x02, 0x00, 0x00, 0x01, 0xC0, 0x01, 0x02, 0x00, 0x00, 0x00, 0x50},
+			want: []byte{0x21, 0x21},
+		},
+		{
+			name:    "Huffman 4-bit with a deeper tree",
+			comment: 0x13,
+			// Root: 0 -> leaf 3, 1 -> node with leaves 5 (10) and 7 (11).
+			data: []byte{0x24, 0x02, 0x00, 0x00, 0x03, 0x80, 0x03, 0xC0, 0x05, 0x07, 0x00, 0x00, 0x00, 0x00, 0x00, 0x58},
+			want: []byte{0x53, 0x37},
+		},
+		{
+			name:    "Diff8bitUnFilter",
+			comment: 0x16,
+			data:    []byte{0x81, 0x04, 0x00, 0x00, 0x10, 0x01, 0xFF, 0x05},
+			want:    []byte{0x10, 0x11, 0x10, 0x15},
+		},
+		{
+			name:    "Diff16bitUnFilter",
+			comment: 0x18,
+			data:    []byte{0x82, 0x06, 0x00, 0x00, 0x00, 0x10, 0x01, 0x00, 0xFF, 0xFF},
+			want:    []byte{0x00, 0x10, 0x01, 0x10, 0x00, 0x10},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cpu := newTestCPU(t)
+			dst := uint32(testBuffer + 0x100)
+			cpu.writeBytes(testBuffer, tt.data)
+			cpu.swi(t, tt.comment, testBuffer, dst)
+			if got := cpu.readBytes(dst, len(tt.want)); !bytes.Equal(got, tt.want) {
+				t.Errorf("output = % X, want % X", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBitUnPack(t *testing.T) {
+	tests := []struct {
+		name   string
+		src    []byte
+		widths [2]byte // source, destination
+		offset uint32
+		want   []uint32
+	}{
+		{"1 to 4 bits with offset", []byte{0xB1}, [2]byte{1, 4}, 1, []uint32{0x20220002}},
+		{"1 to 4 bits offset on zeros", []byte{0xB1}, [2]byte{1, 4}, 1 | 1<<31, []uint32{0x21221112}},
+		{"2 to 8 bits", []byte{0xE4}, [2]byte{2, 8}, 0, []uint32{0x03020100}},
+		{"4 to 16 bits", []byte{0x21, 0x43}, [2]byte{4, 16}, 0x10, []uint32{0x00120011, 0x00140013}},
+		{"8 to 32 bits", []byte{0x05, 0x00}, [2]byte{8, 32}, 0x100, []uint32{0x105, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cpu := newTestCPU(t)
+			info := uint32(testBuffer + 0x80)
+			dst := uint32(testBuffer + 0x100)
+			cpu.writeBytes(testBuffer, tt.src)
+			cpu.Bus.Write16(info, uint16(len(tt.src)))
+			cpu.Bus.Write8(info+2, tt.widths[0])
+			cpu.Bus.Write8(info+3, tt.widths[1])
+			cpu.Bus.Write32(info+4, tt.offset)
+			cpu.swi(t, 0x10, testBuffer, dst, info)
+			for i, want := range tt.want {
+				if got := cpu.Bus.Read32(dst + uint32(4*i)); got != want {
+					t.Errorf("word %d = %08X, want %08X", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestMidiKey2Freq(t *testing.T) {
+	tests := []struct {
+		key, fine uint32
+		want      uint32
+	}{
+		{180, 0, 0x3C000000},
+		{168, 0, 0x1E000000},
+		{156, 0, 0x0F000000},
+		{167, 0x80, 0x1D255D84}, // 12.5 semitones down
+	}
+	for _, tt := range tests {
+		cpu := newTestCPU(t)
+		cpu.Bus.Write32(testBuffer+4, 0x3C000000)
+		cpu.swi(t, 0x1F, testBuffer, tt.key, tt.fine)
+		if got := cpu.ReadReg(0); got != tt.want {
+			t.Errorf("MidiKey2Freq(%d, %d) = %#x, want %#x", tt.key, tt.fine, got, tt.want)
+		}
+	}
+}
+
+// TestIntrWaitWithIRQsMasked calls IntrWait with CPSR.I set. The BIOS
+// enables IRQs for the wait, so the game's handler still runs and raises
+// the BIOS flags, and the caller gets its CPSR.I back on return.
+func TestIntrWaitWithIRQsMasked(t *testing.T) {
+	cpu := newTestCPU(t)
+	cpu.Bus.LoadBIOS(HLEBIOS())
+	put := func(addr uint32, opcodes ...uint32) {
+		for i, opcode := range opcodes {
+			cpu.Bus.Write32(addr+uint32(4*i), opcode)
+		}
+	}
+	const caller, handler = 0x3000000, 0x3001000
+	put(caller,
+		0xEF040000, // swi 0x04
+		0xEAFFFFFE, // b .
+	)
+	put(handler,
+		0xE3A00301, // mov r0, #0x4000000
+		0xE2800C02, // add r0, r0, #0x200
+		0xE3A01001, // mov r1, #1
+		0xE1C010B2, // strh r1, [r0, #2]   (IF)
+		0xE3A02403, // mov r2, #0x3000000
+		0xE2822C7F, // add r2, r2, #0x7F00
+		0xE28220F8, // add r2, r2, #0xF8
+		0xE1C210B0, // strh r1, [r2]       (BIOS flags)
+		0xE12FFF1E, // bx lr
+	)
+	cpu.Bus.Write32(0x3007FFC, handler)
+	cpu.IRQ.IE = 1
+
+	cpu.DirectBoot()
+	cpu.CPSR |= BitI
+	cpu.WriteReg(0, 1) // discard old flags
+	cpu.WriteReg(1, 1) // VBlank
+	cpu.WriteReg(15, caller)
+	cpu.ResetPipeline()
+
+	cpu.Step()
+	if !cpu.IRQ.Halted {
+		t.Fatal("not halted by IntrWait")
+	}
+	if (cpu.CPSR & BitI) != 0 {
+		t.Error("IRQs still masked during the wait")
+	}
+	cpu.IRQ.IF |= 1
+	for i := 0; i < 100 && (cpu.hleWaiting || cpu.ReadReg(15) != caller+12); i++ {
+		cpu.Step()
+	}
+	if cpu.hleWaiting {
+		t.Fatal("IntrWait did not return")
+	}
+	if got := cpu.ReadReg(15); got != caller+12 {
+		t.Errorf("PC = %#x, want the loop after the SWI", got)
+	}
+	if (cpu.CPSR & BitI) == 0 {
+		t.Error("CPSR.I not restored after the wait")
+	}
+	if got := cpu.Bus.Read16(biosIF); got != 0 {
+		t.Errorf("BIOS flags = %#x, want them acknowledged", got)
+	}
+}
+
+func TestRegisterRamResetForcesBlank(t *testing.T) {
+	for _, flags := range []uint32{0x00, 0x01, 0x80, 0xFF} {
+		cpu := newTestCPU(t)
+		cpu.Bus.Write16(0x4000000, 0x1403) // mode 3, BG2, OBJ
+		cpu.swi(t, 0x01, flags)
+		if got := cpu.Bus.Read16(0x4000000); got != 0x80 {
+			t.Errorf("flags %#02x: DISPCNT = %#04x, want 0x0080", flags, got)
+		}
+	}
+}
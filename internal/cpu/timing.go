@@ -0,0 +1,68 @@
+package cpu
+
+import "github.com/Div9851/gba-go/internal/bus"
+
+// Memory accesses made by instructions go through these helpers so that the
+// wait states of the bus region are counted. An access that continues right
+// after the previous one of the same instruction (LDM, STM) is sequential.
+// A data access to the Game Pak flushes the prefetch buffer.
+
+func (cpu *CPU) dataCycles(addr uint32, width int) {
+	seq := cpu.dataAccesses > 0 && addr == cpu.nextDataAddr
+	cycles := cpu.Bus.AccessCycles(addr, width, seq)
+	if bus.IsROMAddr(addr) {
+		cpu.Bus.PrefetchStop()
+		cpu.romCycles += cycles
+	}
+	cpu.cycles += cycles
+	cpu.nextDataAddr = addr + uint32(width)
+	cpu.dataAccesses++
+}
+
+func (cpu *CPU) read8(addr uint32) byte {
+	cpu.dataCycles(addr, 1)
+	cpu.loaded = true
+	return cpu.Bus.Read8(addr)
+}
+
+func (cpu *CPU) read16(addr uint32) uint16 {
+	cpu.dataCycles(addr, 2)
+	cpu.loaded = true
+	return cpu.Bus.Read16(addr)
+}
+
+func (cpu *CPU) read32(addr uint32) uint32 {
+	cpu.dataCycles(addr, 4)
+	cpu.loaded = true
+	return cpu.Bus.Read32(addr)
+}
+
+func (cpu *CPU) write8(addr uint32, val byte) {
+	cpu.dataCycles(addr, 1)
+	cpu.Bus.Write8(addr, val)
+}
+
+func (cpu *CPU) write16(addr uint32, val uint16) {
+	cpu.dataCycles(addr, 2)
+	cpu.Bus.Write16(addr, val)
+}
+
+func (cpu *CPU) write32(addr uint32, val uint32) {
+	cpu.dataCycles(addr, 4)
+	cpu.Bus.Write32(addr, val)
+}
+
+// multiplyCycles returns the internal cycles of a multiply, which depend on
+// how many upper bytes of the multiplier are all zeros (or all ones when
+// signed).
+func multiplyCycles(rs uint32, signed bool) int {
+	switch {
+	case rs&0xFFFFFF00 == 0 || (signed && rs&0xFFFFFF00 == 0xFFFFFF00):
+		return 1
+	case rs&0xFFFF0000 == 0 || (signed && rs&0xFFFF0000 == 0xFFFF0000):
+		return 2
+	case rs&0xFF000000 == 0 || (signed && rs&0xFF000000 == 0xFF000000):
+		return 3
+	}
+	return 4
+}
@@ -3,6 +3,8 @@ package dma
 import (
 	"github.com/Div9851/gba-go/internal/irq"
 	"github.com/Div9851/gba-go/internal/memory"
+	"github.com/Div9851/gba-go/internal/scheduler"
+	"github.com/Div9851/gba-go/internal/state"
 )
 
 const (
@@ -20,14 +22,26 @@ const (
 	Active
 )
 
+// TransferObserver is implemented by memories that need to see a DMA
+// transfer before it runs (the EEPROM sizes itself from the word count).
+type TransferObserver interface {
+	ObserveDMA(src uint32, dst uint32, wordCount int)
+}
+
+const (
+	// A triggered channel starts this many cycles later.
+	startDelay = 2
+)
+
 type Channel struct {
-	index  int
-	SAD    uint32
-	DAD    uint32
-	CNT_L  uint16
-	CNT_H  uint16
-	Memory memory.Memory
-	IRQ    *irq.IRQ
+	index     int
+	SAD       uint32
+	DAD       uint32
+	CNT_L     uint16
+	CNT_H     uint16
+	Memory    memory.Memory
+	IRQ       *irq.IRQ
+	Scheduler *scheduler.Scheduler
 
 	srcAddr    uint32
 	dstAddr    uint32
@@ -37,17 +51,23 @@ type Channel struct {
 	dstAddrCnt int
 	repeat     bool
 	triggerIRQ bool
-	cycles     int
 	Cond       int
 	Status     int
 }
 
-func NewChannel(index int, memory memory.Memory, irq *irq.IRQ) *Channel {
-	return &Channel{
-		index:  index,
-		Memory: memory,
-		IRQ:    irq,
+func NewChannel(index int, memory memory.Memory, irq *irq.IRQ, scheduler *scheduler.Scheduler) *Channel {
+	ch := &Channel{
+		index:     index,
+		Memory:    memory,
+		IRQ:       irq,
+		Scheduler: scheduler,
 	}
+	scheduler.Handle(ch.event(), ch.start)
+	return ch
+}
+
+func (ch *Channel) event() int {
+	return scheduler.EventDMA0 + ch.index
 }
 
 func (ch *Channel) SetCNT_H(value uint16) {
@@ -55,59 +75,73 @@ func (ch *Channel) SetCNT_H(value uint16) {
 	ch.CNT_H = value
 	if (oldValue&(1<<15)) == 0 && (value&(1<<15)) != 0 {
 		ch.Load()
-		ch.cycles = 0
 		ch.Status = Wait
+		if ch.Cond == Immediate {
+			ch.Trigger()
+		}
 	} else if (oldValue&(1<<15)) != 0 && (value&(1<<15)) == 0 {
-		ch.cycles = 0
+		ch.Scheduler.Cancel(ch.event())
 		ch.Status = Idle
 	}
 }
 
-func (ch *Channel) Step() {
-	ch.cycles++
-
-	if ch.cycles >= 2*ch.wordCount+2 {
-		for i := 0; i < ch.wordCount; i++ {
-			if ch.wordSize == 2 {
-				value := ch.Memory.Read16(ch.srcAddr)
-				ch.Memory.Write16(ch.dstAddr, value)
-			} else {
-				value := ch.Memory.Read32(ch.srcAddr)
-				ch.Memory.Write32(ch.dstAddr, value)
-			}
-			switch ch.srcAddrCnt {
-			case 0: // Increment
-				ch.srcAddr += ch.wordSize
-			case 1: // Decrement
-				ch.srcAddr -= ch.wordSize
-			}
-			switch ch.dstAddrCnt {
-			case 0:
-				ch.dstAddr += ch.wordSize
-			case 1: // Decrement
-				ch.dstAddr -= ch.wordSize
-			case 3: // Increment + Reload
-				ch.dstAddr += ch.wordSize
-			}
-		}
+func (ch *Channel) start() {
+	if ch.Status == Wait {
+		ch.Status = Triggered
+	}
+}
 
-		if ch.triggerIRQ {
-			ch.IRQ.IF |= 1 << (8 + ch.index)
-		}
+// Run performs the whole transfer of a triggered channel and returns the
+// cycles it took. The CPU is stalled meanwhile.
+func (ch *Channel) Run() int {
+	ch.Status = Active
+	cycles := 2 // internal cycles before the first access
 
-		if !ch.repeat { // not repeat
-			ch.CNT_H &= 0x7FFF
-			ch.cycles = 0
-			ch.Status = Idle
+	if observer, ok := ch.Memory.(TransferObserver); ok {
+		observer.ObserveDMA(ch.srcAddr, ch.dstAddr, ch.wordCount)
+	}
+	for i := 0; i < ch.wordCount; i++ {
+		seq := i > 0
+		cycles += ch.Memory.AccessCycles(ch.srcAddr, int(ch.wordSize), seq)
+		cycles += ch.Memory.AccessCycles(ch.dstAddr, int(ch.wordSize), seq)
+		if ch.wordSize == 2 {
+			value := ch.Memory.Read16(ch.srcAddr)
+			ch.Memory.Write16(ch.dstAddr, value)
 		} else {
-			ch.LoadWordCount()
-			if ch.dstAddrCnt == 3 {
-				ch.LoadDAD()
-			}
-			ch.cycles = 0
-			ch.Status = Wait
+			value := ch.Memory.Read32(ch.srcAddr)
+			ch.Memory.Write32(ch.dstAddr, value)
+		}
+		switch ch.srcAddrCnt {
+		case 0: // Increment
+			ch.srcAddr += ch.wordSize
+		case 1: // Decrement
+			ch.srcAddr -= ch.wordSize
 		}
+		switch ch.dstAddrCnt {
+		case 0:
+			ch.dstAddr += ch.wordSize
+		case 1: // Decrement
+			ch.dstAddr -= ch.wordSize
+		case 3: // Increment + Reload
+			ch.dstAddr += ch.wordSize
+		}
+	}
+
+	if ch.triggerIRQ {
+		ch.IRQ.IF |= 1 << (8 + ch.index)
+	}
+
+	if !ch.repeat || ch.Cond == Immediate {
+		ch.CNT_H &= 0x7FFF
+		ch.Status = Idle
+	} else {
+		ch.LoadWordCount()
+		if ch.dstAddrCnt == 3 {
+			ch.LoadDAD()
+		}
+		ch.Status = Wait
 	}
+	return cycles
 }
 
 func (ch *Channel) LoadSAD() {
@@ -189,5 +223,41 @@ func (ch *Channel) Load() {
 }
 
 func (ch *Channel) Trigger() {
-	ch.Status = Triggered
+	if !ch.Scheduler.Pending(ch.event()) {
+		ch.Scheduler.Schedule(ch.event(), startDelay)
+	}
+}
+
+func (ch *Channel) SaveState(w *state.Writer) {
+	w.Write(ch.SAD)
+	w.Write(ch.DAD)
+	w.Write(ch.CNT_L)
+	w.Write(ch.CNT_H)
+	w.Write(ch.srcAddr)
+	w.Write(ch.dstAddr)
+	w.Write(ch.wordSize)
+	w.WriteInt(ch.wordCount)
+	w.WriteInt(ch.srcAddrCnt)
+	w.WriteInt(ch.dstAddrCnt)
+	w.Write(ch.repeat)
+	w.Write(ch.triggerIRQ)
+	w.WriteInt(ch.Cond)
+	w.WriteInt(ch.Status)
+}
+
+func (ch *Channel) LoadState(r *state.Reader) {
+	r.Read(&ch.SAD)
+	r.Read(&ch.DAD)
+	r.Read(&ch.CNT_L)
+	r.Read(&ch.CNT_H)
+	r.Read(&ch.srcAddr)
+	r.Read(&ch.dstAddr)
+	r.Read(&ch.wordSize)
+	r.ReadInt(&ch.wordCount)
+	r.ReadInt(&ch.srcAddrCnt)
+	r.ReadInt(&ch.dstAddrCnt)
+	r.Read(&ch.repeat)
+	r.Read(&ch.triggerIRQ)
+	r.ReadInt(&ch.Cond)
+	r.ReadInt(&ch.Status)
 }
@@ -2,30 +2,233 @@ package gamepak
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/Div9851/gba-go/internal/state"
 )
 
 type GamePak struct {
-	ROM    [32 * 1024 * 1024]byte
-	Backup BackupDevice
+	ROM      [32 * 1024 * 1024]byte
+	Backup   BackupDevice
+	GPIO     *GPIO // nil if the cartridge has no GPIO peripheral
+	RTC      *RTC
+	romSize  int
+	saveType SaveType
 }
 
-func GetBackupDevice(data []byte) BackupDevice {
-	if bytes.Contains(data, []byte("SRAM")) {
-		return &SRAM{}
-	} else if bytes.Contains(data, []byte("FLASH1M")) {
-		return &Flash128K{}
+var (
+	ErrStateMismatch = errors.New("gamepak: save state is for another cartridge type")
+	ErrBackupSize    = errors.New("gamepak: save file size does not match the save type")
+)
+
+type SaveType int
+
+const (
+	SaveTypeAuto SaveType = iota
+	SaveTypeNone
+	SaveTypeSRAM
+	SaveTypeEEPROM // size detected from the first DMA transfer
+	SaveTypeEEPROM512
+	SaveTypeEEPROM8K
+	SaveTypeFlash64K  // Panasonic
+	SaveTypeFlash128K // Sanyo
+	SaveTypeFlash64KAtmel
+	SaveTypeFlash64KMacronix
+	SaveTypeFlash128KMacronix
+)
+
+var saveTypeNames = map[SaveType]string{
+	SaveTypeAuto:      "auto",
+	SaveTypeNone:      "none",
+	SaveTypeSRAM:      "sram",
+	SaveTypeEEPROM:    "eeprom",
+	SaveTypeEEPROM512: "eeprom512",
+	SaveTypeEEPROM8K:  "eeprom8k",
+	SaveTypeFlash64K:  "flash64k",
+	SaveTypeFlash128K: "flash128k",
+
+	SaveTypeFlash64KAtmel:     "flash64k-atmel",
+	SaveTypeFlash64KMacronix:  "flash64k-macronix",
+	SaveTypeFlash128KMacronix: "flash128k-macronix",
+}
+
+// Some games check the IDs reported by the flash chip, so each flash save
+// type is one part.
+var flashChips = map[SaveType]FlashChip{
+	SaveTypeFlash64K:          FlashPanasonic64K,
+	SaveTypeFlash128K:         FlashSanyo128K,
+	SaveTypeFlash64KAtmel:     FlashAtmel64K,
+	SaveTypeFlash64KMacronix:  FlashMacronix64K,
+	SaveTypeFlash128KMacronix: FlashMacronix128K,
+}
+
+func (t SaveType) String() string {
+	if name, ok := saveTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("SaveType(%d)", int(t))
+}
+
+func ParseSaveType(name string) (SaveType, error) {
+	for t, n := range saveTypeNames {
+		if strings.EqualFold(n, name) {
+			return t, nil
+		}
+	}
+	return SaveTypeAuto, fmt.Errorf("gamepak: unknown save type %q", name)
+}
+
+// Library version strings that Nintendo's SDK embeds in the ROM. None is
+// a substring of another; if a ROM contains several, the first one listed
+// wins.
+var saveTypeMarkers = []struct {
+	marker   string
+	saveType SaveType
+}{
+	{"EEPROM_V", SaveTypeEEPROM},
+	{"SRAM_F_V", SaveTypeSRAM},
+	{"SRAM_V", SaveTypeSRAM},
+	{"FLASH1M_V", SaveTypeFlash128K},
+	{"FLASH512_V", SaveTypeFlash64K},
+	{"FLASH_V", SaveTypeFlash64K},
+}
+
+type cartridgeOverride struct {
+	saveType SaveType
+	rtc      bool
+}
+
+// Games whose library strings are missing or misleading, keyed by the
+// game code in the ROM header.
+var cartridgeOverrides = map[string]cartridgeOverride{
+	"A2YE": {saveType: SaveTypeNone},                         // Top Gun - Combat Zones
+	"AFXE": {saveType: SaveTypeFlash64K},                     // Final Fantasy Tactics Advance
+	"AI2E": {saveType: SaveTypeNone},                         // Iridion II
+	"ALFE": {saveType: SaveTypeEEPROM},                       // Dragon Ball Z - The Legacy of Goku II
+	"AREE": {saveType: SaveTypeSRAM},                         // Mega Man Battle Network
+	"AW2E": {saveType: SaveTypeFlash64K},                     // Advance Wars 2
+	"AWRE": {saveType: SaveTypeFlash64K},                     // Advance Wars
+	"AX4E": {saveType: SaveTypeFlash128K},                    // Super Mario Advance 4
+	"AXPE": {saveType: SaveTypeFlash128K, rtc: true},         // Pokemon Sapphire
+	"AXVE": {saveType: SaveTypeFlash128K, rtc: true},         // Pokemon Ruby
+	"AZCE": {saveType: SaveTypeSRAM},                         // Mega Man Zero
+	"BPEE": {saveType: SaveTypeFlash128KMacronix, rtc: true}, // Pokemon Emerald
+	"BPGE": {saveType: SaveTypeFlash128KMacronix},            // Pokemon LeafGreen
+	"BPRE": {saveType: SaveTypeFlash128KMacronix},            // Pokemon FireRed
+	"BSME": {saveType: SaveTypeEEPROM},                       // Metal Slug Advance
+}
+
+func GameCode(data []byte) string {
+	if len(data) < 0xB0 {
+		return ""
+	}
+	return string(data[0xAC:0xB0])
+}
+
+func DetectSaveType(data []byte) SaveType {
+	if override, ok := cartridgeOverrides[GameCode(data)]; ok {
+		return override.saveType
+	}
+	for _, m := range saveTypeMarkers {
+		if bytes.Contains(data, []byte(m.marker)) {
+			return m.saveType
+		}
 	}
 	// fallback
+	return SaveTypeSRAM
+}
+
+// HasRTC reports whether the cartridge has the GPIO real-time clock,
+// either from the override table or the SIIRTC_V library string.
+func HasRTC(data []byte) bool {
+	if override, ok := cartridgeOverrides[GameCode(data)]; ok && override.rtc {
+		return true
+	}
+	return bytes.Contains(data, []byte("SIIRTC_V"))
+}
+
+func NewBackupDevice(saveType SaveType) BackupDevice {
+	switch saveType {
+	case SaveTypeNone:
+		return &NoBackup{}
+	case SaveTypeEEPROM:
+		return &EEPROM{}
+	case SaveTypeEEPROM512:
+		return &EEPROM{size: 512}
+	case SaveTypeEEPROM8K:
+		return &EEPROM{size: 8 * 1024}
+	}
+	if chip, ok := flashChips[saveType]; ok {
+		return NewFlash(chip)
+	}
 	return &SRAM{}
 }
 
+func GetBackupDevice(data []byte) BackupDevice {
+	return NewBackupDevice(DetectSaveType(data))
+}
+
+// IsEEPROMAddr reports whether addr hits the EEPROM. It occupies the whole
+// 0xDxxxxxx region, or only its last 256 bytes when the ROM is larger than
+// 16MB.
+func (gamepak *GamePak) IsEEPROMAddr(addr uint32) bool {
+	if _, ok := gamepak.Backup.(*EEPROM); !ok {
+		return false
+	}
+	if gamepak.romSize > 16*1024*1024 {
+		return 0xDFFFF00 <= addr && addr < 0xE000000
+	}
+	return 0xD000000 <= addr && addr < 0xE000000
+}
+
 type BackupDevice interface {
 	Read8(addr uint32) byte
 	Write8(addr uint32, value byte)
+	// Export returns a copy of the raw backup contents (the .sav image).
+	Export() []byte
+	// Import replaces the backup contents with a .sav image.
+	Import(data []byte) error
+	// Dirty reports whether the contents changed since the last ClearDirty.
+	Dirty() bool
+	ClearDirty()
+	// SaveState and LoadState cover the command in progress. The contents
+	// belong to the .sav file and are not part of a save state.
+	SaveState(w *state.Writer)
+	LoadState(r *state.Reader)
 }
 
+// NoBackup is used by games without a backup device.
+type NoBackup struct{}
+
+func (nb *NoBackup) Read8(addr uint32) byte {
+	return 0xFF
+}
+
+func (nb *NoBackup) Write8(addr uint32, value byte) {}
+
+func (nb *NoBackup) Export() []byte {
+	return nil
+}
+
+func (nb *NoBackup) Import(data []byte) error {
+	return nil
+}
+
+func (nb *NoBackup) Dirty() bool {
+	return false
+}
+
+func (nb *NoBackup) ClearDirty() {}
+
+func (nb *NoBackup) SaveState(w *state.Writer) {}
+
+func (nb *NoBackup) LoadState(r *state.Reader) {}
+
 type SRAM struct {
-	data [32 * 1024]byte
+	data  [32 * 1024]byte
+	dirty bool
 }
 
 func (sram *SRAM) Read8(addr uint32) byte {
@@ -33,77 +236,464 @@ func (sram *SRAM) Read8(addr uint32) byte {
 }
 
 func (sram *SRAM) Write8(addr uint32, value byte) {
-	sram.data[addr&0x7FFF] = value
+	if sram.data[addr&0x7FFF] != value {
+		sram.data[addr&0x7FFF] = value
+		sram.dirty = true
+	}
 }
 
+func (sram *SRAM) Export() []byte {
+	return bytes.Clone(sram.data[:])
+}
+
+func (sram *SRAM) Import(data []byte) error {
+	copy(sram.data[:], data)
+	return nil
+}
+
+func (sram *SRAM) Dirty() bool {
+	return sram.dirty
+}
+
+func (sram *SRAM) ClearDirty() {
+	sram.dirty = false
+}
+
+func (sram *SRAM) SaveState(w *state.Writer) {}
+
+func (sram *SRAM) LoadState(r *state.Reader) {}
+
 const (
-	None = iota
-	EnterIDMode1
-	EnterIOMode2
-	IOMode
-	TerminateIOMode1
-	TerminateIOMode2
+	FlashReady = iota
+	FlashCommand1
+	FlashCommand2
+	FlashProgram
+	FlashBankSelect
+	FlashPageWrite
+)
+
+// FlashChip identifies a flash part by the IDs it reports in ID mode.
+type FlashChip struct {
+	Manufacturer byte
+	Device       byte
+	Size         int
+}
+
+var (
+	FlashPanasonic64K = FlashChip{Manufacturer: 0x32, Device: 0x1B, Size: 64 * 1024}
+	FlashAtmel64K     = FlashChip{Manufacturer: 0x1F, Device: 0x3D, Size: 64 * 1024}
+	FlashMacronix64K  = FlashChip{Manufacturer: 0xC2, Device: 0x1C, Size: 64 * 1024}
+	FlashSanyo128K    = FlashChip{Manufacturer: 0x62, Device: 0x13, Size: 128 * 1024}
+	FlashMacronix128K = FlashChip{Manufacturer: 0xC2, Device: 0x09, Size: 128 * 1024}
 )
 
-type Flash128K struct {
-	data  [128 * 1024]byte
-	state int
+// Flash is a 64K or 128K flash backup. Commands are written as
+// AA->5555, 55->2AAA, cmd->5555:
+//
+//	90/F0      enter/exit ID mode
+//	80 + 10    chip erase (80, then AA/55 again, then 10->5555)
+//	80 + 30    erase the 4K sector written to
+//	A0         program the next byte (Atmel: the next 128-byte page)
+//	B0         select the 64K bank by writing it to 0000 (128K only)
+type Flash struct {
+	data       [128 * 1024]byte
+	chip       FlashChip
+	state      int
+	idMode     bool
+	eraseArmed bool
+	bank       int
+	pageCount  int
+	dirty      bool
+}
+
+func NewFlash(chip FlashChip) *Flash {
+	flash := &Flash{
+		chip: chip,
+	}
+	for i := range flash.data {
+		flash.data[i] = 0xFF
+	}
+	return flash
+}
+
+func (flash *Flash) isAtmel() bool {
+	return flash.chip.Manufacturer == FlashAtmel64K.Manufacturer
 }
 
-func (flush *Flash128K) Read8(addr uint32) byte {
-	if EnterIDMode1 <= flush.state && flush.state <= IOMode {
-		// Sanyo
+func (flash *Flash) Read8(addr uint32) byte {
+	addr &= 0xFFFF
+	if flash.idMode {
 		if addr == 0x0 { // man
-			return 0x62
+			return flash.chip.Manufacturer
 		}
 		if addr == 0x1 { // dev
-			return 0x13
+			return flash.chip.Device
 		}
 	}
-	return flush.data[addr]
+	return flash.data[flash.bank*0x10000+int(addr)]
 }
 
-func (flash *Flash128K) Write8(addr uint32, value byte) {
+func (flash *Flash) Write8(addr uint32, value byte) {
+	addr &= 0xFFFF
 	switch flash.state {
-	case None:
+	case FlashReady:
 		if addr == 0x5555 && value == 0xAA {
-			flash.state = EnterIDMode1
+			flash.state = FlashCommand1
+		} else if value == 0xF0 {
+			flash.idMode = false
+			flash.eraseArmed = false
 		}
-	case EnterIDMode1:
+	case FlashCommand1:
 		if addr == 0x2AAA && value == 0x55 {
-			flash.state = EnterIOMode2
+			flash.state = FlashCommand2
 		} else {
-			flash.state = None
+			flash.state = FlashReady
 		}
-	case EnterIOMode2:
-		if addr == 0x5555 && value == 0x90 {
-			flash.state = IOMode
-		} else {
-			flash.state = None
+	case FlashCommand2:
+		flash.state = FlashReady
+		if flash.eraseArmed {
+			flash.eraseArmed = false
+			if addr == 0x5555 && value == 0x10 { // chip erase
+				flash.erase(0, flash.chip.Size)
+			} else if value == 0x30 { // sector erase
+				flash.erase(flash.bank*0x10000+int(addr&0xF000), 0x1000)
+			}
+			return
 		}
-	case IOMode:
-		if addr == 0x5555 && value == 0xAA {
-			flash.state = TerminateIOMode1
+		if addr != 0x5555 {
+			return
 		}
-	case TerminateIOMode1:
-		if addr == 0x2AAA && value == 0x55 {
-			flash.state = TerminateIOMode2
-		} else {
-			flash.state = IOMode
+		switch value {
+		case 0x90:
+			flash.idMode = true
+		case 0xF0:
+			flash.idMode = false
+		case 0x80:
+			flash.eraseArmed = true
+		case 0xA0:
+			if flash.isAtmel() {
+				flash.state = FlashPageWrite
+				flash.pageCount = 0
+			} else {
+				flash.state = FlashProgram
+			}
+		case 0xB0:
+			if flash.chip.Size > 0x10000 {
+				flash.state = FlashBankSelect
+			}
 		}
-	case TerminateIOMode2:
-		if addr == 0x5555 && value == 0xF0 {
-			flash.state = None
-		} else {
-			flash.state = IOMode
+	case FlashProgram:
+		flash.program(flash.bank*0x10000+int(addr), value)
+		flash.state = FlashReady
+	case FlashBankSelect:
+		if addr == 0x0 {
+			flash.bank = int(value & 1)
+		}
+		flash.state = FlashReady
+	case FlashPageWrite:
+		if flash.pageCount == 0 {
+			flash.erase(flash.bank*0x10000+int(addr&0xFF80), 128)
+		}
+		flash.program(flash.bank*0x10000+int(addr), value)
+		flash.pageCount++
+		if flash.pageCount >= 128 {
+			flash.state = FlashReady
+		}
+	}
+}
+
+func (flash *Flash) program(offset int, value byte) {
+	if flash.data[offset] != value {
+		flash.data[offset] = value
+		flash.dirty = true
+	}
+}
+
+func (flash *Flash) erase(offset int, length int) {
+	for i := offset; i < offset+length; i++ {
+		flash.program(i, 0xFF)
+	}
+}
+
+func (flash *Flash) Export() []byte {
+	return bytes.Clone(flash.data[:flash.chip.Size])
+}
+
+func (flash *Flash) Import(data []byte) error {
+	copy(flash.data[:flash.chip.Size], data)
+	return nil
+}
+
+func (flash *Flash) Dirty() bool {
+	return flash.dirty
+}
+
+func (flash *Flash) ClearDirty() {
+	flash.dirty = false
+}
+
+func (flash *Flash) SaveState(w *state.Writer) {
+	w.WriteInt(flash.state)
+	w.Write(flash.idMode)
+	w.Write(flash.eraseArmed)
+	w.WriteInt(flash.bank)
+	w.WriteInt(flash.pageCount)
+}
+
+func (flash *Flash) LoadState(r *state.Reader) {
+	r.ReadInt(&flash.state)
+	r.Read(&flash.idMode)
+	r.Read(&flash.eraseArmed)
+	r.ReadInt(&flash.bank)
+	r.ReadInt(&flash.pageCount)
+	flash.bank &= 1
+	flash.pageCount = min(max(flash.pageCount, 0), 127)
+}
+
+const (
+	EEPROMIdle = iota
+	EEPROMReadAddr
+	EEPROMReadStop
+	EEPROMReading
+	EEPROMWriteAddr
+	EEPROMWriteData
+	EEPROMWriteStop
+)
+
+// EEPROM is a 512B or 8KB serial EEPROM. It is accessed one bit per
+// halfword (bit 0), normally through DMA3.
+//
+//	read request:  11 <addr> 0         then 4 dummy bits + 64 data bits
+//	write request: 10 <addr> <64 bits> 0
+type EEPROM struct {
+	data     [8 * 1024]byte
+	size     int // 0 until detected
+	state    int
+	bits     uint64
+	bitCount int
+	addr     int
+	readPos  int
+	dirty    bool
+}
+
+// DetectSize picks the address width from the length of a DMA transfer
+// into the EEPROM: 9/73 bits for 6-bit addresses (512B) and 17/81 bits
+// for 14-bit addresses (8KB).
+func (eeprom *EEPROM) DetectSize(transferLength int) {
+	if eeprom.size != 0 {
+		return
+	}
+	switch transferLength {
+	case 9, 73:
+		eeprom.size = 512
+	case 17, 81:
+		eeprom.size = 8 * 1024
+	}
+}
+
+func (eeprom *EEPROM) addrBits() int {
+	if eeprom.size == 512 {
+		return 6
+	}
+	return 14
+}
+
+func (eeprom *EEPROM) blockAddr() int {
+	if eeprom.size == 512 {
+		return (eeprom.addr & 0x3F) * 8
+	}
+	return (eeprom.addr & 0x3FF) * 8
+}
+
+func (eeprom *EEPROM) Read8(addr uint32) byte {
+	if (addr & 1) != 0 {
+		return 0
+	}
+	if eeprom.state != EEPROMReading {
+		return 1 // ready
+	}
+	pos := eeprom.readPos
+	eeprom.readPos++
+	if eeprom.readPos >= 68 {
+		eeprom.state = EEPROMIdle
+	}
+	if pos < 4 {
+		return 0
+	}
+	pos -= 4
+	b := eeprom.data[eeprom.blockAddr()+pos/8]
+	return (b >> (7 - pos%8)) & 1
+}
+
+func (eeprom *EEPROM) Write8(addr uint32, value byte) {
+	if (addr & 1) != 0 {
+		return
+	}
+	bit := uint64(value & 1)
+	eeprom.bits = eeprom.bits<<1 | bit
+	eeprom.bitCount++
+
+	switch eeprom.state {
+	case EEPROMIdle, EEPROMReading:
+		if eeprom.state == EEPROMReading {
+			// a new request aborts the pending read
+			eeprom.state = EEPROMIdle
+			eeprom.bits = bit
+			eeprom.bitCount = 1
+		}
+		if eeprom.bitCount < 2 {
+			return
+		}
+		switch eeprom.bits & 3 {
+		case 0x3:
+			eeprom.state = EEPROMReadAddr
+		case 0x2:
+			eeprom.state = EEPROMWriteAddr
+		default:
+			eeprom.bits &= 1
+			eeprom.bitCount = 1
+			return
+		}
+		eeprom.bits = 0
+		eeprom.bitCount = 0
+	case EEPROMReadAddr:
+		if eeprom.bitCount == eeprom.addrBits() {
+			eeprom.addr = int(eeprom.bits)
+			eeprom.state = EEPROMReadStop
+			eeprom.bits = 0
+			eeprom.bitCount = 0
 		}
+	case EEPROMReadStop:
+		eeprom.state = EEPROMReading
+		eeprom.readPos = 0
+		eeprom.bits = 0
+		eeprom.bitCount = 0
+	case EEPROMWriteAddr:
+		if eeprom.bitCount == eeprom.addrBits() {
+			eeprom.addr = int(eeprom.bits)
+			eeprom.state = EEPROMWriteData
+			eeprom.bits = 0
+			eeprom.bitCount = 0
+		}
+	case EEPROMWriteData:
+		if eeprom.bitCount == 64 {
+			base := eeprom.blockAddr()
+			for i := 0; i < 8; i++ {
+				b := byte(eeprom.bits >> (56 - 8*i))
+				if eeprom.data[base+i] != b {
+					eeprom.data[base+i] = b
+					eeprom.dirty = true
+				}
+			}
+			eeprom.state = EEPROMWriteStop
+			eeprom.bits = 0
+			eeprom.bitCount = 0
+		}
+	case EEPROMWriteStop:
+		eeprom.state = EEPROMIdle
+		eeprom.bits = 0
+		eeprom.bitCount = 0
+	}
+}
+
+func (eeprom *EEPROM) Export() []byte {
+	if eeprom.size == 512 {
+		return bytes.Clone(eeprom.data[:512])
 	}
-	flash.data[addr] = value
+	return bytes.Clone(eeprom.data[:])
 }
 
-func NewGamePak(data []byte) *GamePak {
-	gamepak := &GamePak{}
+// Import takes the size from the file unless the save type forced one, in
+// which case a file of the other size is rejected.
+func (eeprom *EEPROM) Import(data []byte) error {
+	if eeprom.size == 0 {
+		if len(data) == 512 || len(data) == 8*1024 {
+			eeprom.size = len(data)
+		}
+	} else if len(data) != eeprom.size {
+		return ErrBackupSize
+	}
+	copy(eeprom.data[:], data)
+	return nil
+}
+
+func (eeprom *EEPROM) Dirty() bool {
+	return eeprom.dirty
+}
+
+func (eeprom *EEPROM) ClearDirty() {
+	eeprom.dirty = false
+}
+
+func (eeprom *EEPROM) SaveState(w *state.Writer) {
+	w.WriteInt(eeprom.size)
+	w.WriteInt(eeprom.state)
+	w.Write(eeprom.bits)
+	w.WriteInt(eeprom.bitCount)
+	w.WriteInt(eeprom.addr)
+	w.WriteInt(eeprom.readPos)
+}
+
+func (eeprom *EEPROM) LoadState(r *state.Reader) {
+	r.ReadInt(&eeprom.size)
+	r.ReadInt(&eeprom.state)
+	r.Read(&eeprom.bits)
+	r.ReadInt(&eeprom.bitCount)
+	r.ReadInt(&eeprom.addr)
+	r.ReadInt(&eeprom.readPos)
+	if eeprom.size != 0 && eeprom.size != 512 && eeprom.size != 8*1024 {
+		r.Fail(ErrStateMismatch)
+		return
+	}
+	if eeprom.state < EEPROMIdle || eeprom.state > EEPROMWriteStop ||
+		eeprom.bitCount < 0 || eeprom.bitCount > 64 ||
+		eeprom.readPos < 0 || eeprom.readPos > 68 {
+		r.Fail(state.ErrInvalidValue)
+	}
+}
+
+func NewGamePak(data []byte, saveType SaveType) *GamePak {
+	gamepak := &GamePak{
+		romSize: len(data),
+	}
 	copy(gamepak.ROM[:], data)
-	gamepak.Backup = GetBackupDevice(data)
+	if saveType == SaveTypeAuto {
+		saveType = DetectSaveType(data)
+	}
+	gamepak.saveType = saveType
+	gamepak.Backup = NewBackupDevice(saveType)
+	if HasRTC(data) {
+		gamepak.RTC = NewRTC()
+		gamepak.GPIO = NewGPIO(gamepak.RTC)
+	}
 	return gamepak
 }
+
+// SaveState writes the state of the backup and GPIO transfers in progress.
+func (gamepak *GamePak) SaveState(w *state.Writer) {
+	w.WriteInt(int(gamepak.saveType))
+	w.Write(gamepak.GPIO != nil)
+	gamepak.Backup.SaveState(w)
+	if gamepak.GPIO != nil {
+		gamepak.GPIO.SaveState(w)
+	}
+}
+
+// LoadState fails with ErrStateMismatch when the state was saved with a
+// different backup device or GPIO.
+func (gamepak *GamePak) LoadState(r *state.Reader) {
+	var saveType int
+	var hasGPIO bool
+	r.ReadInt(&saveType)
+	r.Read(&hasGPIO)
+	if r.Err() == nil && (SaveType(saveType) != gamepak.saveType || hasGPIO != (gamepak.GPIO != nil)) {
+		r.Fail(ErrStateMismatch)
+	}
+	if r.Err() != nil {
+		return
+	}
+	gamepak.Backup.LoadState(r)
+	if gamepak.GPIO != nil {
+		gamepak.GPIO.LoadState(r)
+	}
+}
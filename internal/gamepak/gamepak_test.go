@@ -0,0 +1,487 @@
+package gamepak
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Div9851/gba-go/internal/state"
+)
+
+// flashCommand writes the AA->5555, 55->2AAA unlock sequence and cmd->5555.
+func flashCommand(flash *Flash, cmd byte) {
+	flash.Write8(0x5555, 0xAA)
+	flash.Write8(0x2AAA, 0x55)
+	flash.Write8(0x5555, cmd)
+}
+
+func flashProgram(flash *Flash, addr uint32, value byte) {
+	flashCommand(flash, 0xA0)
+	flash.Write8(addr, value)
+}
+
+func TestFlashSaveTypes(t *testing.T) {
+	tests := []struct {
+		name string
+		want FlashChip
+	}{
+		{"flash64k", FlashPanasonic64K},
+		{"flash128k", FlashSanyo128K},
+		{"flash64k-atmel", FlashAtmel64K},
+		{"flash64k-macronix", FlashMacronix64K},
+		{"flash128k-macronix", FlashMacronix128K},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			saveType, err := ParseSaveType(tt.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			flash, ok := NewBackupDevice(saveType).(*Flash)
+			if !ok {
+				t.Fatalf("%v is not a flash device", saveType)
+			}
+			if flash.chip != tt.want {
+				t.Errorf("chip = %+v, want %+v", flash.chip, tt.want)
+			}
+		})
+	}
+}
+
+func TestFlashIDMode(t *testing.T) {
+	chips := []FlashChip{FlashPanasonic64K, FlashAtmel64K, FlashMacronix64K, FlashSanyo128K, FlashMacronix128K}
+	for _, chip := range chips {
+		flash := NewFlash(chip)
+		flash.data[0], flash.data[1] = 0x12, 0x34
+		flashCommand(flash, 0x90)
+		if man, dev := flash.Read8(0), flash.Read8(1); man != chip.Manufacturer || dev != chip.Device {
+			t.Errorf("%+v: ID = %02X %02X", chip, man, dev)
+		}
+		flashCommand(flash, 0xF0)
+		if b0, b1 := flash.Read8(0), flash.Read8(1); b0 != 0x12 || b1 != 0x34 {
+			t.Errorf("%+v: after exit read %02X %02X, want data", chip, b0, b1)
+		}
+	}
+}
+
+func TestFlashCommands(t *testing.T) {
+	tests := []struct {
+		name string
+		chip FlashChip
+		run  func(flash *Flash)
+		want map[int]byte // offsets in the exported image
+	}{
+		{
+			name: "byte program",
+			chip: FlashPanasonic64K,
+			run:  func(flash *Flash) { flashProgram(flash, 0x1234, 0x5A) },
+			want: map[int]byte{0x1234: 0x5A, 0x1235: 0xFF},
+		},
+		{
+			name: "program without command is ignored",
+			chip: FlashPanasonic64K,
+			run:  func(flash *Flash) { flash.Write8(0x1234, 0x5A) },
+			want: map[int]byte{0x1234: 0xFF},
+		},
+		{
+			name: "sector erase",
+			chip: FlashPanasonic64K,
+			run: func(flash *Flash) {
+				flashProgram(flash, 0x0FFF, 0x01)
+				flashProgram(flash, 0x1000, 0x02)
+				flashProgram(flash, 0x1FFF, 0x03)
+				flashProgram(flash, 0x2000, 0x04)
+				flashCommand(flash, 0x80)
+				flash.Write8(0x5555, 0xAA)
+				flash.Write8(0x2AAA, 0x55)
+				flash.Write8(0x1000, 0x30)
+			},
+			want: map[int]byte{0x0FFF: 0x01, 0x1000: 0xFF, 0x1FFF: 0xFF, 0x2000: 0x04},
+		},
+		{
+			name: "chip erase",
+			chip: FlashSanyo128K,
+			run: func(flash *Flash) {
+				flashProgram(flash, 0x0000, 0x01)
+				flashCommand(flash, 0xB0)
+				flash.Write8(0x0000, 1)
+				flashProgram(flash, 0xFFFF, 0x02)
+				flashCommand(flash, 0x80)
+				flashCommand(flash, 0x10)
+			},
+			want: map[int]byte{0x00000: 0xFF, 0x1FFFF: 0xFF},
+		},
+		{
+			name: "bank switch",
+			chip: FlashMacronix128K,
+			run: func(flash *Flash) {
+				flashProgram(flash, 0x0010, 0x01)
+				flashCommand(flash, 0xB0)
+				flash.Write8(0x0000, 1)
+				flashProgram(flash, 0x0010, 0x02)
+			},
+			want: map[int]byte{0x00010: 0x01, 0x10010: 0x02},
+		},
+		{
+			name: "sector erase in bank 1",
+			chip: FlashSanyo128K,
+			run: func(flash *Flash) {
+				flashProgram(flash, 0x3000, 0x01)
+				flashCommand(flash, 0xB0)
+				flash.Write8(0x0000, 1)
+				flashProgram(flash, 0x3000, 0x02)
+				flashCommand(flash, 0x80)
+				flash.Write8(0x5555, 0xAA)
+				flash.Write8(0x2AAA, 0x55)
+				flash.Write8(0x3000, 0x30)
+			},
+			want: map[int]byte{0x03000: 0x01, 0x13000: 0xFF},
+		},
+		{
+			name: "no bank switch on 64K",
+			chip: FlashPanasonic64K,
+			run: func(flash *Flash) {
+				flashCommand(flash, 0xB0)
+				flash.Write8(0x0000, 1)
+				flashProgram(flash, 0x0010, 0x02)
+			},
+			want: map[int]byte{0x0010: 0x02},
+		},
+		{
+			name: "atmel page write",
+			chip: FlashAtmel64K,
+			run: func(flash *Flash) {
+				flashCommand(flash, 0xA0)
+				for i := uint32(0); i < 128; i++ {
+					flash.Write8(0x0180+i, byte(i))
+				}
+				// The page is done, so this is not programmed.
+				flash.Write8(0x0200, 0x00)
+			},
+			want: map[int]byte{0x017F: 0xFF, 0x0180: 0x00, 0x01FF: 0x7F, 0x0200: 0xFF},
+		},
+		{
+			name: "atmel page write rewrites a page",
+			chip: FlashAtmel64K,
+			run: func(flash *Flash) {
+				flashCommand(flash, 0xA0)
+				for i := uint32(0); i < 128; i++ {
+					flash.Write8(0x0000+i, 0x00)
+				}
+				flashCommand(flash, 0xA0)
+				flash.Write8(0x0000, 0x11)
+				for i := uint32(1); i < 128; i++ {
+					flash.Write8(0x0000+i, 0xFF)
+				}
+			},
+			want: map[int]byte{0x0000: 0x11, 0x0001: 0xFF, 0x007F: 0xFF},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			flash := NewFlash(tt.chip)
+			tt.run(flash)
+			data := flash.Export()
+			if len(data) != tt.chip.Size {
+				t.Fatalf("exported %d bytes, want %d", len(data), tt.chip.Size)
+			}
+			for offset, want := range tt.want {
+				if got := data[offset]; got != want {
+					t.Errorf("data[%#x] = %#02x, want %#02x", offset, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestFlashStateMidCommand(t *testing.T) {
+	flash := NewFlash(FlashSanyo128K)
+	flashCommand(flash, 0xB0)
+	flash.Write8(0x0000, 1)
+	flashCommand(flash, 0xA0)
+
+	var buf bytes.Buffer
+	flash.SaveState(state.NewWriter(&buf))
+	restored := NewFlash(FlashSanyo128K)
+	restored.LoadState(state.NewReader(&buf))
+	restored.Write8(0x0010, 0x42)
+	if got := restored.Export()[0x10010]; got != 0x42 {
+		t.Errorf("byte programmed after load = %#02x, want 0x42", got)
+	}
+}
+
+// eepromSend plays a DMA transfer of bits into the EEPROM, one per halfword.
+func eepromSend(eeprom *EEPROM, bits []byte) {
+	eeprom.DetectSize(len(bits))
+	for i, bit := range bits {
+		eeprom.Write8(0xD000000+uint32(2*i), bit)
+	}
+}
+
+// eepromRequest builds a request: the 2-bit command, the address, then
+// the data bits (if any) and the stop bit.
+func eepromRequest(cmd byte, addr int, addrBits int, data []byte) []byte {
+	bits := []byte{cmd >> 1, cmd & 1}
+	for i := addrBits - 1; i >= 0; i-- {
+		bits = append(bits, byte(addr>>i)&1)
+	}
+	bits = append(bits, data...)
+	return append(bits, 0)
+}
+
+func eepromBits(value uint64) []byte {
+	bits := make([]byte, 64)
+	for i := range bits {
+		bits[i] = byte(value>>(63-i)) & 1
+	}
+	return bits
+}
+
+func TestEEPROM(t *testing.T) {
+	tests := []struct {
+		name     string
+		addrBits int
+		addr     int
+		wantSize int
+	}{
+		{"512B", 6, 0x2A, 512},
+		{"8KB", 14, 0x3A5, 8 * 1024},
+	}
+	const value = 0x0123456789ABCDEF
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			eeprom := &EEPROM{}
+			write := eepromRequest(0x2, tt.addr, tt.addrBits, eepromBits(value))
+			if len(write) != 9+64 && len(write) != 17+64 {
+				t.Fatalf("write request is %d bits", len(write))
+			}
+			eepromSend(eeprom, write)
+			if eeprom.size != tt.wantSize {
+				t.Fatalf("size = %d, want %d", eeprom.size, tt.wantSize)
+			}
+			if !eeprom.Dirty() {
+				t.Error("not dirty after a write")
+			}
+			if got := eeprom.Read8(0xD000000); got != 1 {
+				t.Errorf("ready bit after write = %d, want 1", got)
+			}
+			if got := eeprom.Export(); len(got) != tt.wantSize || got[tt.addr*8] != 0x01 || got[tt.addr*8+7] != 0xEF {
+				t.Errorf("block in export = % X", got[tt.addr*8:tt.addr*8+8])
+			}
+
+			eepromSend(eeprom, eepromRequest(0x3, tt.addr, tt.addrBits, nil))
+			var got uint64
+			for i := 0; i < 68; i++ {
+				bit := eeprom.Read8(0xD000000 + uint32(2*i))
+				if i < 4 {
+					if bit != 0 {
+						t.Errorf("dummy bit %d = %d", i, bit)
+					}
+					continue
+				}
+				got = got<<1 | uint64(bit)
+			}
+			if got != value {
+				t.Errorf("read %016X, want %016X", got, uint64(value))
+			}
+			if bit := eeprom.Read8(0xD000000); bit != 1 {
+				t.Errorf("ready bit after read = %d, want 1", bit)
+			}
+		})
+	}
+}
+
+func TestEEPROMDetectSize(t *testing.T) {
+	tests := []struct {
+		length int
+		want   int
+	}{
+		{9, 512},
+		{73, 512},
+		{17, 8 * 1024},
+		{81, 8 * 1024},
+		{68, 0}, // a read transfer says nothing about the size
+	}
+	for _, tt := range tests {
+		eeprom := &EEPROM{}
+		eeprom.DetectSize(tt.length)
+		if eeprom.size != tt.want {
+			t.Errorf("DetectSize(%d): size = %d, want %d", tt.length, eeprom.size, tt.want)
+		}
+		if tt.want == 0 {
+			continue
+		}
+		// Once detected, the size sticks.
+		eeprom.DetectSize(9)
+		eeprom.DetectSize(17)
+		if eeprom.size != tt.want {
+			t.Errorf("DetectSize(%d): size changed to %d by a later transfer", tt.length, eeprom.size)
+		}
+	}
+}
+
+func TestEEPROMStateOutOfRange(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(eeprom *EEPROM)
+	}{
+		{"read position", func(eeprom *EEPROM) { eeprom.readPos = 100000 }},
+		{"negative read position", func(eeprom *EEPROM) { eeprom.readPos = -1 }},
+		{"bit count", func(eeprom *EEPROM) { eeprom.bitCount = 65 }},
+		{"state", func(eeprom *EEPROM) { eeprom.state = EEPROMWriteStop + 1 }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			saved := &EEPROM{size: 8 * 1024, state: EEPROMReading}
+			tt.modify(saved)
+			var buf bytes.Buffer
+			saved.SaveState(state.NewWriter(&buf))
+			r := state.NewReader(&buf)
+			(&EEPROM{}).LoadState(r)
+			if err := r.Err(); !errors.Is(err, state.ErrInvalidValue) {
+				t.Errorf("error = %v, want %v", err, state.ErrInvalidValue)
+			}
+		})
+	}
+}
+
+func TestEEPROMImport(t *testing.T) {
+	tests := []struct {
+		name     string
+		saveType SaveType
+		length   int
+		wantSize int
+		wantErr  error
+	}{
+		{"detect 512B", SaveTypeEEPROM, 512, 512, nil},
+		{"detect 8KB", SaveTypeEEPROM, 8 * 1024, 8 * 1024, nil},
+		{"forced 512B", SaveTypeEEPROM512, 512, 512, nil},
+		{"forced 8KB", SaveTypeEEPROM8K, 8 * 1024, 8 * 1024, nil},
+		{"8KB file for forced 512B", SaveTypeEEPROM512, 8 * 1024, 512, ErrBackupSize},
+		{"512B file for forced 8KB", SaveTypeEEPROM8K, 512, 8 * 1024, ErrBackupSize},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			eeprom := NewBackupDevice(tt.saveType).(*EEPROM)
+			err := eeprom.Import(bytes.Repeat([]byte{0x5A}, tt.length))
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("error = %v, want %v", err, tt.wantErr)
+			}
+			if eeprom.size != tt.wantSize {
+				t.Errorf("size = %d, want %d", eeprom.size, tt.wantSize)
+			}
+		})
+	}
+}
+
+// rtcTransfer runs one RTC command over the GPIO pins (SCK: 0, SIO: 1,
+// CS: 2): it writes the data bytes, or reads readLength bytes back.
+func rtcTransfer(rtc *RTC, command int, data []byte, readLength int) []byte {
+	const out, in = 7, 5 // pin directions with SIO driven by the GBA or the RTC
+	sendByte := func(b byte) {
+		for i := 0; i < 8; i++ {
+			bit := (b >> i) & 1
+			rtc.WritePins(4|bit<<1, out)
+			rtc.WritePins(5|bit<<1, out)
+		}
+	}
+	rtc.WritePins(1, out) // CS low
+	rtc.WritePins(5, out) // CS high
+	cmd := byte(0x6 | command<<4)
+	if readLength > 0 {
+		cmd |= 0x80
+	}
+	sendByte(cmd)
+	for _, b := range data {
+		sendByte(b)
+	}
+	result := make([]byte, readLength)
+	for i := 0; i < 8*readLength; i++ {
+		rtc.WritePins(4, in)
+		rtc.WritePins(5, in)
+		result[i/8] |= (rtc.ReadPins() >> 1 & 1) << (i % 8)
+	}
+	rtc.WritePins(1, out)
+	return result
+}
+
+func TestRTC(t *testing.T) {
+	host := time.Date(2024, time.May, 6, 13, 14, 15, 0, time.UTC) // a Monday
+	newRTC := func() *RTC {
+		rtc := NewRTC()
+		rtc.Now = func() time.Time { return host }
+		return rtc
+	}
+	tests := []struct {
+		name string
+		run  func(rtc *RTC) []byte
+		want []byte
+	}{
+		{
+			name: "date and time follow the host clock",
+			run:  func(rtc *RTC) []byte { return rtcTransfer(rtc, rtcCommandDateTime, nil, 7) },
+			want: []byte{0x24, 0x05, 0x06, 0x01, 0x13, 0x14, 0x15},
+		},
+		{
+			name: "time",
+			run:  func(rtc *RTC) []byte { return rtcTransfer(rtc, rtcCommandTime, nil, 3) },
+			want: []byte{0x13, 0x14, 0x15},
+		},
+		{
+			name: "status defaults to 24-hour mode",
+			run:  func(rtc *RTC) []byte { return rtcTransfer(rtc, rtcCommandControl, nil, 1) },
+			want: []byte{0x40},
+		},
+		{
+			name: "status write keeps the writable bits",
+			run: func(rtc *RTC) []byte {
+				rtcTransfer(rtc, rtcCommandControl, []byte{0xFF}, 0)
+				return rtcTransfer(rtc, rtcCommandControl, nil, 1)
+			},
+			want: []byte{0x6A},
+		},
+		{
+			name: "12-hour mode",
+			run: func(rtc *RTC) []byte {
+				rtcTransfer(rtc, rtcCommandControl, []byte{0x00}, 0)
+				return rtcTransfer(rtc, rtcCommandTime, nil, 3)
+			},
+			want: []byte{0x81, 0x14, 0x15},
+		},
+		{
+			name: "date and time write",
+			run: func(rtc *RTC) []byte {
+				rtcTransfer(rtc, rtcCommandDateTime, []byte{0x31, 0x12, 0x25, 0x04, 0x23, 0x59, 0x58}, 0)
+				return rtcTransfer(rtc, rtcCommandDateTime, nil, 7)
+			},
+			want: []byte{0x31, 0x12, 0x25, 0x04, 0x23, 0x59, 0x58},
+		},
+		{
+			name: "time write keeps the date",
+			run: func(rtc *RTC) []byte {
+				rtcTransfer(rtc, rtcCommandTime, []byte{0x01, 0x02, 0x03}, 0)
+				return rtcTransfer(rtc, rtcCommandDateTime, nil, 7)
+			},
+			want: []byte{0x24, 0x05, 0x06, 0x01, 0x01, 0x02, 0x03},
+		},
+		{
+			name: "reset restarts from 2000-01-01",
+			run: func(rtc *RTC) []byte {
+				rtcTransfer(rtc, rtcCommandReset, nil, 0)
+				date := rtcTransfer(rtc, rtcCommandDateTime, nil, 7)
+				return append(date, rtcTransfer(rtc, rtcCommandControl, nil, 1)...)
+			},
+			// A Saturday, and the status register cleared to 12-hour mode.
+			want: []byte{0x00, 0x01, 0x01, 0x06, 0x00, 0x00, 0x00, 0x00},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rtc := newRTC()
+			if got := tt.run(rtc); !bytes.Equal(got, tt.want) {
+				t.Errorf("read % X, want % X", got, tt.want)
+			}
+		})
+	}
+}
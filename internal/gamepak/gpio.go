@@ -0,0 +1,341 @@
+package gamepak
+
+import (
+	"time"
+
+	"github.com/Div9851/gba-go/internal/state"
+)
+
+// GPIO is the 4-bit general purpose port at 0x80000C4-0x80000C9 used by
+// cartridge peripherals such as the real-time clock.
+//
+//	0x80000C4  data
+//	0x80000C6  direction (1 = output from the GBA)
+//	0x80000C8  control (bit 0: port readable)
+type GPIO struct {
+	data      byte
+	direction byte
+	control   byte
+	Device    GPIODevice
+}
+
+type GPIODevice interface {
+	// WritePins receives the pin levels after a GBA write. Only the bits
+	// set in direction are driven by the GBA.
+	WritePins(value byte, direction byte)
+	// ReadPins returns the pin levels driven by the device.
+	ReadPins() byte
+	SaveState(w *state.Writer)
+	LoadState(r *state.Reader)
+}
+
+func NewGPIO(device GPIODevice) *GPIO {
+	return &GPIO{
+		Device: device,
+	}
+}
+
+func IsGPIOAddr(addr uint32) bool {
+	return 0x80000C4 <= addr && addr < 0x80000CA
+}
+
+// Readable reports whether reads of the port return the GPIO registers
+// rather than ROM data.
+func (gpio *GPIO) Readable() bool {
+	return (gpio.control & 1) != 0
+}
+
+func (gpio *GPIO) Read8(addr uint32) byte {
+	switch addr {
+	case 0x0:
+		return ((gpio.data & gpio.direction) | (gpio.Device.ReadPins() & ^gpio.direction)) & 0xF
+	case 0x2:
+		return gpio.direction
+	case 0x4:
+		return gpio.control
+	}
+	return 0
+}
+
+func (gpio *GPIO) Write8(addr uint32, value byte) {
+	switch addr {
+	case 0x0:
+		gpio.data = value & 0xF
+		gpio.Device.WritePins(gpio.data, gpio.direction)
+	case 0x2:
+		gpio.direction = value & 0xF
+	case 0x4:
+		gpio.control = value & 1
+	}
+}
+
+const (
+	RTCIdle = iota
+	RTCCommand
+	RTCRead
+	RTCWrite
+)
+
+const (
+	rtcCommandReset    = 0
+	rtcCommandDateTime = 2
+	rtcCommandForceIRQ = 3
+	rtcCommandControl  = 4
+	rtcCommandTime     = 6
+)
+
+var rtcCommandLength = [8]int{0, 0, 7, 0, 1, 0, 3, 0}
+
+// RTC is the Seiko S-3511 real-time clock on the GPIO port (SCK: pin 0,
+// SIO: pin 1, CS: pin 2). Bits are sent LSB first and latched on the rising
+// edge of SCK. The clock follows the host clock shifted by Offset.
+type RTC struct {
+	Offset time.Duration
+	Now    func() time.Time
+
+	state     int
+	sck       bool
+	cs        bool
+	sio       byte
+	command   int
+	value     byte
+	bitCount  int
+	buffer    [7]byte
+	byteIndex int
+	control   byte
+	dirty     bool
+}
+
+func NewRTC() *RTC {
+	return &RTC{
+		Now:     time.Now,
+		control: 0x40, // 24-hour mode
+	}
+}
+
+// Dirty reports whether the game changed the clock since the last
+// ClearDirty, so the offset should be persisted.
+func (rtc *RTC) Dirty() bool {
+	return rtc.dirty
+}
+
+func (rtc *RTC) ClearDirty() {
+	rtc.dirty = false
+}
+
+func (rtc *RTC) ReadPins() byte {
+	return rtc.sio << 1
+}
+
+func (rtc *RTC) WritePins(value byte, direction byte) {
+	sck := (value & 1) != 0
+	sio := (value >> 1) & 1
+	cs := (value & 4) != 0
+	prevSCK, prevCS := rtc.sck, rtc.cs
+	rtc.sck, rtc.cs = sck, cs
+
+	if !cs {
+		rtc.state = RTCIdle
+		return
+	}
+	if !prevCS {
+		rtc.state = RTCCommand
+		rtc.value = 0
+		rtc.bitCount = 0
+		return
+	}
+	if prevSCK || !sck { // rising edge only
+		return
+	}
+
+	switch rtc.state {
+	case RTCCommand, RTCWrite:
+		if (direction & 2) == 0 {
+			return
+		}
+		rtc.value |= sio << rtc.bitCount
+		rtc.bitCount++
+		if rtc.bitCount < 8 {
+			return
+		}
+		if rtc.state == RTCCommand {
+			rtc.processCommand(rtc.value)
+		} else {
+			rtc.buffer[rtc.byteIndex] = rtc.value
+			rtc.byteIndex++
+			if rtc.byteIndex >= rtcCommandLength[rtc.command] {
+				rtc.finishWrite()
+				rtc.state = RTCIdle
+			}
+		}
+		rtc.value = 0
+		rtc.bitCount = 0
+	case RTCRead:
+		rtc.sio = (rtc.buffer[rtc.byteIndex] >> rtc.bitCount) & 1
+		rtc.bitCount++
+		if rtc.bitCount >= 8 {
+			rtc.bitCount = 0
+			rtc.byteIndex++
+			if rtc.byteIndex >= rtcCommandLength[rtc.command] {
+				rtc.state = RTCIdle
+			}
+		}
+	}
+}
+
+func (rtc *RTC) processCommand(value byte) {
+	if (value & 0xF) != 0x6 {
+		rtc.state = RTCIdle
+		return
+	}
+	rtc.command = int((value >> 4) & 0x7)
+	read := (value & 0x80) != 0
+	rtc.byteIndex = 0
+
+	switch rtc.command {
+	case rtcCommandReset:
+		// The chip restarts from 2000-01-01 00:00:00.
+		now := rtc.Now()
+		rtc.control = 0
+		rtc.Offset = time.Date(2000, time.January, 1, 0, 0, 0, 0, now.Location()).Sub(now).Round(time.Second)
+		rtc.dirty = true
+		rtc.state = RTCIdle
+		return
+	case rtcCommandForceIRQ:
+		rtc.state = RTCIdle
+		return
+	}
+	if rtcCommandLength[rtc.command] == 0 {
+		rtc.state = RTCIdle
+		return
+	}
+	if read {
+		rtc.fillBuffer()
+		rtc.state = RTCRead
+	} else {
+		rtc.state = RTCWrite
+	}
+}
+
+func (rtc *RTC) now() time.Time {
+	return rtc.Now().Add(rtc.Offset)
+}
+
+func (rtc *RTC) encodeHour(hour int) byte {
+	if (rtc.control & 0x40) != 0 {
+		return toBCD(hour)
+	}
+	h := toBCD(hour % 12)
+	if hour >= 12 {
+		h |= 0x80
+	}
+	return h
+}
+
+func (rtc *RTC) decodeHour(value byte) int {
+	hour := fromBCD(value & 0x3F)
+	if (rtc.control&0x40) == 0 && (value&0x80) != 0 {
+		hour += 12
+	}
+	return hour % 24
+}
+
+func (rtc *RTC) fillBuffer() {
+	t := rtc.now()
+	switch rtc.command {
+	case rtcCommandDateTime:
+		rtc.buffer[0] = toBCD(t.Year() % 100)
+		rtc.buffer[1] = toBCD(int(t.Month()))
+		rtc.buffer[2] = toBCD(t.Day())
+		rtc.buffer[3] = toBCD(int(t.Weekday()))
+		rtc.buffer[4] = rtc.encodeHour(t.Hour())
+		rtc.buffer[5] = toBCD(t.Minute())
+		rtc.buffer[6] = toBCD(t.Second())
+	case rtcCommandTime:
+		rtc.buffer[0] = rtc.encodeHour(t.Hour())
+		rtc.buffer[1] = toBCD(t.Minute())
+		rtc.buffer[2] = toBCD(t.Second())
+	case rtcCommandControl:
+		rtc.buffer[0] = rtc.control
+	}
+}
+
+func (rtc *RTC) finishWrite() {
+	t := rtc.now()
+	switch rtc.command {
+	case rtcCommandDateTime:
+		t = time.Date(2000+fromBCD(rtc.buffer[0]), time.Month(fromBCD(rtc.buffer[1])), fromBCD(rtc.buffer[2]),
+			rtc.decodeHour(rtc.buffer[4]), fromBCD(rtc.buffer[5]), fromBCD(rtc.buffer[6]), 0, t.Location())
+	case rtcCommandTime:
+		t = time.Date(t.Year(), t.Month(), t.Day(),
+			rtc.decodeHour(rtc.buffer[0]), fromBCD(rtc.buffer[1]), fromBCD(rtc.buffer[2]), 0, t.Location())
+	case rtcCommandControl:
+		rtc.control = rtc.buffer[0] & 0x6A
+		return
+	}
+	rtc.Offset = t.Sub(rtc.Now()).Round(time.Second)
+	rtc.dirty = true
+}
+
+func toBCD(value int) byte {
+	return byte((value/10)<<4 | value%10)
+}
+
+func fromBCD(value byte) int {
+	return int(value>>4)*10 + int(value&0xF)
+}
+
+func (gpio *GPIO) SaveState(w *state.Writer) {
+	w.Write(gpio.data)
+	w.Write(gpio.direction)
+	w.Write(gpio.control)
+	gpio.Device.SaveState(w)
+}
+
+func (gpio *GPIO) LoadState(r *state.Reader) {
+	r.Read(&gpio.data)
+	r.Read(&gpio.direction)
+	r.Read(&gpio.control)
+	gpio.Device.LoadState(r)
+}
+
+// SaveState writes the serial transfer in progress. The clock offset is
+// kept in the .rtc file instead.
+func (rtc *RTC) SaveState(w *state.Writer) {
+	w.WriteInt(rtc.state)
+	w.Write(rtc.sck)
+	w.Write(rtc.cs)
+	w.Write(rtc.sio)
+	w.WriteInt(rtc.command)
+	w.Write(rtc.value)
+	w.WriteInt(rtc.bitCount)
+	w.Write(rtc.buffer[:])
+	w.WriteInt(rtc.byteIndex)
+	w.Write(rtc.control)
+}
+
+func (rtc *RTC) LoadState(r *state.Reader) {
+	r.ReadInt(&rtc.state)
+	r.Read(&rtc.sck)
+	r.Read(&rtc.cs)
+	r.Read(&rtc.sio)
+	r.ReadInt(&rtc.command)
+	r.Read(&rtc.value)
+	r.ReadInt(&rtc.bitCount)
+	r.Read(rtc.buffer[:])
+	r.ReadInt(&rtc.byteIndex)
+	r.Read(&rtc.control)
+	if rtc.command < 0 || rtc.command >= len(rtcCommandLength) || rtc.state < RTCIdle || rtc.state > RTCWrite {
+		r.Fail(state.ErrInvalidValue)
+		return
+	}
+	// A finished transfer leaves byteIndex at the command length; one in
+	// progress is still inside the buffer.
+	length := rtcCommandLength[rtc.command]
+	if rtc.state == RTCRead || rtc.state == RTCWrite {
+		length--
+	}
+	if rtc.byteIndex < 0 || rtc.byteIndex > length || rtc.bitCount < 0 || rtc.bitCount > 7 {
+		r.Fail(state.ErrInvalidValue)
+	}
+}
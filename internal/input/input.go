@@ -1,6 +1,9 @@
 package input
 
-import "github.com/Div9851/gba-go/internal/irq"
+import (
+	"github.com/Div9851/gba-go/internal/irq"
+	"github.com/Div9851/gba-go/internal/state"
+)
 
 const (
 	ButtonA uint16 = 1
@@ -62,3 +65,13 @@ func (input *Input) SetKeys(keys []string) {
 
 	input.KEYINPUT = keyInput
 }
+
+func (input *Input) SaveState(w *state.Writer) {
+	w.Write(input.KEYINPUT)
+	w.Write(input.KEYCNT)
+}
+
+func (input *Input) LoadState(r *state.Reader) {
+	r.Read(&input.KEYINPUT)
+	r.Read(&input.KEYCNT)
+}
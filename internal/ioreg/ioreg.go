@@ -6,6 +6,7 @@ import (
 	"github.com/Div9851/gba-go/internal/input"
 	"github.com/Div9851/gba-go/internal/irq"
 	"github.com/Div9851/gba-go/internal/ppu"
+	"github.com/Div9851/gba-go/internal/state"
 	"github.com/Div9851/gba-go/internal/timer"
 )
 
@@ -18,6 +19,8 @@ type IOReg struct {
 	DMA          [4]*dma.Channel
 	Input        *input.Input
 	Timers       [4]*timer.Timer
+	WAITCNT      uint16
+	POSTFLG      byte
 	shouldCommit bool
 }
 
@@ -37,6 +40,9 @@ func (r *IOReg) Read8(addr uint32) byte {
 	case addr < 0x2: // DISPCNT
 		b := addr * 8
 		return byte((r.PPU.DISPCNT >> b) & 0xFF)
+	case 0x2 <= addr && addr < 0x4: // GREENSWAP
+		b := (addr - 0x2) * 8
+		return byte((r.PPU.GREENSWAP >> b) & 0xFF)
 	case 0x4 <= addr && addr < 0x6: // DISPSTAT
 		b := (addr - 0x4) * 8
 		return byte((r.PPU.DISPSTAT >> b) & 0xFF)
@@ -55,6 +61,18 @@ func (r *IOReg) Read8(addr uint32) byte {
 	case 0xE <= addr && addr < 0x10: // BG3CNT
 		b := (addr - 0xE) * 8
 		return byte((r.PPU.BGCNT[3] >> b) & 0xFF)
+	case 0x48 <= addr && addr < 0x4A: // WININ
+		b := (addr - 0x48) * 8
+		return byte((r.PPU.WININ >> b) & 0xFF)
+	case 0x4A <= addr && addr < 0x4C: // WINOUT
+		b := (addr - 0x4A) * 8
+		return byte((r.PPU.WINOUT >> b) & 0xFF)
+	case 0x50 <= addr && addr < 0x52: // BLDCNT
+		b := (addr - 0x50) * 8
+		return byte((r.PPU.BLDCNT >> b) & 0xFF)
+	case 0x52 <= addr && addr < 0x54: // BLDALPHA
+		b := (addr - 0x52) * 8
+		return byte((r.PPU.BLDALPHA >> b) & 0xFF)
 	case 0x60 <= addr && addr < 0x62: // SOUND1CNT_L
 		b := (addr - 0x60) * 8
 		return byte((r.APU.Channel1.CNT_L >> b) & 0xFF)
@@ -86,17 +104,19 @@ func (r *IOReg) Read8(addr uint32) byte {
 		b := (addr - 0x7C) * 8
 		return byte((r.APU.Channel4.CNT_H >> b) & 0xFF)
 	case 0x90 <= addr && addr < 0xA0: // WAVE_RAM
-		index := addr - 0x90
-		if (r.APU.Channel3.CNT_L & (1 << 6)) == 0 {
-			index += 16
-		}
-		return r.APU.Channel3.RAM[index]
+		return r.APU.Channel3.ReadRAM(int(addr - 0x90))
 	case 0x80 <= addr && addr < 0x82: // SOUNDCNT_L
 		b := (addr - 0x80) * 8
 		return byte((r.APU.SOUNDCNT_L >> b) & 0xFF)
 	case 0x82 <= addr && addr < 0x84: // SOUNDCNT_H
 		b := (addr - 0x82) * 8
 		return byte((r.APU.SOUNDCNT_H >> b) & 0xFF)
+	case 0x84 <= addr && addr < 0x86: // SOUNDCNT_X
+		b := (addr - 0x84) * 8
+		return byte((r.APU.ReadSOUNDCNT_X() >> b) & 0xFF)
+	case 0x88 <= addr && addr < 0x8A: // SOUNDBIAS
+		b := (addr - 0x88) * 8
+		return byte((r.APU.SOUNDBIAS >> b) & 0xFF)
 	case 0xBA <= addr && addr < 0xBC: // DMA0CNT_H
 		b := (addr - 0xBA) * 8
 		return byte((r.DMA[0].CNT_H >> b) & 0xFF)
@@ -111,16 +131,16 @@ func (r *IOReg) Read8(addr uint32) byte {
 		return byte((r.DMA[3].CNT_H >> b) & 0xFF)
 	case 0x100 <= addr && addr < 0x102: // TM0CNT_L
 		b := (addr - 0x100) * 8
-		return byte((r.Timers[0].TMCNT_L >> b) & 0xFF)
+		return byte((r.Timers[0].Counter() >> b) & 0xFF)
 	case 0x104 <= addr && addr < 0x106: // TM1CNT_L
 		b := (addr - 0x104) * 8
-		return byte((r.Timers[1].TMCNT_L >> b) & 0xFF)
+		return byte((r.Timers[1].Counter() >> b) & 0xFF)
 	case 0x108 <= addr && addr < 0x10A: // TM2CNT_L
 		b := (addr - 0x108) * 8
-		return byte((r.Timers[2].TMCNT_L >> b) & 0xFF)
+		return byte((r.Timers[2].Counter() >> b) & 0xFF)
 	case 0x10C <= addr && addr < 0x10E: // TM3CNT_L
 		b := (addr - 0x10C) * 8
-		return byte((r.Timers[3].TMCNT_L >> b) & 0xFF)
+		return byte((r.Timers[3].Counter() >> b) & 0xFF)
 	case 0x102 <= addr && addr < 0x104: // TM0CNT_H
 		b := (addr - 0x102) * 8
 		return byte((r.Timers[0].TMCNT_H >> b) & 0xFF)
@@ -148,6 +168,11 @@ func (r *IOReg) Read8(addr uint32) byte {
 	case 0x208 <= addr && addr < 0x20C: // IME
 		b := (addr - 0x208) * 8
 		return byte((r.IRQ.IME >> b) & 0xFF)
+	case 0x204 <= addr && addr < 0x206: // WAITCNT
+		b := (addr - 0x204) * 8
+		return byte((r.WAITCNT >> b) & 0xFF)
+	case addr == 0x300: // POSTFLG
+		return r.POSTFLG
 	}
 	// Unknown
 	return 0xFF
@@ -211,7 +236,12 @@ func (r *IOReg) Commit() {
 	}
 	if mask := r.getMask16(0x0); mask != 0 { // DISPCNT
 		value := r.readBuffer16(0x0) & mask
-		r.PPU.DISPCNT = (r.PPU.DISPCNT & ^mask) | value
+		r.PPU.SetDISPCNT((r.PPU.DISPCNT & ^mask) | value)
+	}
+	if mask := r.getMask16(0x2); mask != 0 { // GREENSWAP
+		mask &= 0x1
+		value := r.readBuffer16(0x2) & mask
+		r.PPU.GREENSWAP = (r.PPU.GREENSWAP & ^mask) | value
 	}
 	if mask := r.getMask16(0x4); mask != 0 { // DISPSTAT
 		mask &= 0xFFB8
@@ -269,18 +299,22 @@ func (r *IOReg) Commit() {
 	if mask := r.getMask16(0x28); mask != 0 { // BG2X_L
 		value := r.readBuffer16(0x28) & mask
 		r.PPU.BGX_L[2] = value
+		r.PPU.ReloadAffineX(2)
 	}
 	if mask := r.getMask16(0x2A); mask != 0 { // BG2X_H
 		value := r.readBuffer16(0x2A) & mask
 		r.PPU.BGX_H[2] = value
+		r.PPU.ReloadAffineX(2)
 	}
 	if mask := r.getMask16(0x2C); mask != 0 { // BG2Y_L
 		value := r.readBuffer16(0x2C) & mask
 		r.PPU.BGY_L[2] = value
+		r.PPU.ReloadAffineY(2)
 	}
 	if mask := r.getMask16(0x2E); mask != 0 { // BG2Y_H
 		value := r.readBuffer16(0x2E) & mask
 		r.PPU.BGY_H[2] = value
+		r.PPU.ReloadAffineY(2)
 	}
 	if mask := r.getMask16(0x20); mask != 0 { // BG2PA
 		value := r.readBuffer16(0x20) & mask
@@ -298,65 +332,130 @@ func (r *IOReg) Commit() {
 		value := r.readBuffer16(0x26) & mask
 		r.PPU.BG_PD[2] = value
 	}
+	if mask := r.getMask16(0x38); mask != 0 { // BG3X_L
+		value := r.readBuffer16(0x38) & mask
+		r.PPU.BGX_L[3] = value
+		r.PPU.ReloadAffineX(3)
+	}
+	if mask := r.getMask16(0x3A); mask != 0 { // BG3X_H
+		value := r.readBuffer16(0x3A) & mask
+		r.PPU.BGX_H[3] = value
+		r.PPU.ReloadAffineX(3)
+	}
+	if mask := r.getMask16(0x3C); mask != 0 { // BG3Y_L
+		value := r.readBuffer16(0x3C) & mask
+		r.PPU.BGY_L[3] = value
+		r.PPU.ReloadAffineY(3)
+	}
+	if mask := r.getMask16(0x3E); mask != 0 { // BG3Y_H
+		value := r.readBuffer16(0x3E) & mask
+		r.PPU.BGY_H[3] = value
+		r.PPU.ReloadAffineY(3)
+	}
+	if mask := r.getMask16(0x30); mask != 0 { // BG3PA
+		value := r.readBuffer16(0x30) & mask
+		r.PPU.BG_PA[3] = value
+	}
+	if mask := r.getMask16(0x32); mask != 0 { // BG3PB
+		value := r.readBuffer16(0x32) & mask
+		r.PPU.BG_PB[3] = value
+	}
+	if mask := r.getMask16(0x34); mask != 0 { // BG3PC
+		value := r.readBuffer16(0x34) & mask
+		r.PPU.BG_PC[3] = value
+	}
+	if mask := r.getMask16(0x36); mask != 0 { // BG3PD
+		value := r.readBuffer16(0x36) & mask
+		r.PPU.BG_PD[3] = value
+	}
+	if mask := r.getMask16(0x40); mask != 0 { // WIN0H
+		value := r.readBuffer16(0x40) & mask
+		r.PPU.WINH[0] = (r.PPU.WINH[0] & ^mask) | value
+	}
+	if mask := r.getMask16(0x42); mask != 0 { // WIN1H
+		value := r.readBuffer16(0x42) & mask
+		r.PPU.WINH[1] = (r.PPU.WINH[1] & ^mask) | value
+	}
+	if mask := r.getMask16(0x44); mask != 0 { // WIN0V
+		value := r.readBuffer16(0x44) & mask
+		r.PPU.WINV[0] = (r.PPU.WINV[0] & ^mask) | value
+	}
+	if mask := r.getMask16(0x46); mask != 0 { // WIN1V
+		value := r.readBuffer16(0x46) & mask
+		r.PPU.WINV[1] = (r.PPU.WINV[1] & ^mask) | value
+	}
+	if mask := r.getMask16(0x48); mask != 0 { // WININ
+		mask &= 0x3F3F
+		value := r.readBuffer16(0x48) & mask
+		r.PPU.WININ = (r.PPU.WININ & ^mask) | value
+	}
+	if mask := r.getMask16(0x4A); mask != 0 { // WINOUT
+		mask &= 0x3F3F
+		value := r.readBuffer16(0x4A) & mask
+		r.PPU.WINOUT = (r.PPU.WINOUT & ^mask) | value
+	}
+	if mask := r.getMask16(0x4C); mask != 0 { // MOSAIC
+		value := r.readBuffer16(0x4C) & mask
+		r.PPU.MOSAIC = (r.PPU.MOSAIC & ^mask) | value
+	}
+	if mask := r.getMask16(0x50); mask != 0 { // BLDCNT
+		mask &= 0x3FFF
+		value := r.readBuffer16(0x50) & mask
+		r.PPU.BLDCNT = (r.PPU.BLDCNT & ^mask) | value
+	}
+	if mask := r.getMask16(0x52); mask != 0 { // BLDALPHA
+		mask &= 0x1F1F
+		value := r.readBuffer16(0x52) & mask
+		r.PPU.BLDALPHA = (r.PPU.BLDALPHA & ^mask) | value
+	}
+	if mask := r.getMask16(0x54); mask != 0 { // BLDY
+		mask &= 0x1F
+		value := r.readBuffer16(0x54) & mask
+		r.PPU.BLDY = (r.PPU.BLDY & ^mask) | value
+	}
 	if mask := r.getMask16(0x60); mask != 0 { // SOUND1CNT_L
 		value := r.readBuffer16(0x60) & mask
-		r.APU.Channel1.CNT_L = (r.APU.Channel1.CNT_L & ^mask) | value
+		r.APU.Channel1.WriteCNT_L((r.APU.Channel1.CNT_L & ^mask) | value)
 	}
 	if mask := r.getMask16(0x62); mask != 0 { // SOUND1CNT_H
 		value := r.readBuffer16(0x62) & mask
-		r.APU.Channel1.CNT_H = (r.APU.Channel1.CNT_H & ^mask) | value
+		r.APU.Channel1.WriteCNT_H((r.APU.Channel1.CNT_H & ^mask) | value)
 	}
 	if mask := r.getMask16(0x64); mask != 0 { // SOUND1CNT_X
 		value := r.readBuffer16(0x64) & mask
-		r.APU.Channel1.CNT_X = (r.APU.Channel1.CNT_X & ^mask) | value
-		if (value & (1 << 15)) != 0 {
-			r.APU.Channel1.Start()
-		}
+		r.APU.Channel1.WriteCNT_X((r.APU.Channel1.CNT_X & ^mask) | value)
 	}
 	if mask := r.getMask16(0x68); mask != 0 { // SOUND2CNT_L
 		value := r.readBuffer16(0x68) & mask
-		r.APU.Channel2.CNT_L = (r.APU.Channel2.CNT_L & ^mask) | value
+		r.APU.Channel2.WriteCNT_L((r.APU.Channel2.CNT_L & ^mask) | value)
 	}
 	if mask := r.getMask16(0x6C); mask != 0 { // SOUND2CNT_H
 		value := r.readBuffer16(0x6C) & mask
-		r.APU.Channel2.CNT_H = (r.APU.Channel2.CNT_H & ^mask) | value
-		if (value & (1 << 15)) != 0 {
-			r.APU.Channel2.Start()
-		}
+		r.APU.Channel2.WriteCNT_H((r.APU.Channel2.CNT_H & ^mask) | value)
 	}
 	if mask := r.getMask16(0x70); mask != 0 { // SOUND3CNT_L
 		value := r.readBuffer16(0x70) & mask
-		r.APU.Channel3.CNT_L = (r.APU.Channel3.CNT_L & ^mask) | value
+		r.APU.Channel3.WriteCNT_L((r.APU.Channel3.CNT_L & ^mask) | value)
 	}
 	if mask := r.getMask16(0x72); mask != 0 { // SOUND3CNT_H
 		value := r.readBuffer16(0x72) & mask
-		r.APU.Channel3.CNT_H = (r.APU.Channel3.CNT_H & ^mask) | value
+		r.APU.Channel3.WriteCNT_H((r.APU.Channel3.CNT_H & ^mask) | value)
 	}
 	if mask := r.getMask16(0x74); mask != 0 { // SOUND3CNT_X
 		value := r.readBuffer16(0x74) & mask
-		r.APU.Channel3.CNT_X = (r.APU.Channel3.CNT_X & ^mask) | value
-		if (value & (1 << 15)) != 0 {
-			r.APU.Channel3.Start()
-		}
+		r.APU.Channel3.WriteCNT_X((r.APU.Channel3.CNT_X & ^mask) | value)
 	}
 	if mask := r.getMask16(0x78); mask != 0 { // SOUND4CNT_L
 		value := r.readBuffer16(0x78) & mask
-		r.APU.Channel4.CNT_L = (r.APU.Channel4.CNT_L & ^mask) | value
+		r.APU.Channel4.WriteCNT_L((r.APU.Channel4.CNT_L & ^mask) | value)
 	}
 	if mask := r.getMask16(0x7C); mask != 0 { // SOUND4CNT_H
 		value := r.readBuffer16(0x7C) & mask
-		r.APU.Channel4.CNT_H = (r.APU.Channel4.CNT_H & ^mask) | value
-		if (value & (1 << 15)) != 0 {
-			r.APU.Channel4.Start()
-		}
+		r.APU.Channel4.WriteCNT_H((r.APU.Channel4.CNT_H & ^mask) | value)
 	}
 	for index := 0; index < 16; index++ {
 		if r.changed[0x90+index] {
-			if (r.APU.Channel3.CNT_L & (1 << 6)) == 0 {
-				r.APU.Channel3.RAM[16+index] = r.buffer[0x90+index]
-			} else {
-				r.APU.Channel3.RAM[index] = r.buffer[0x90+index]
-			}
+			r.APU.Channel3.WriteRAM(index, r.buffer[0x90+index])
 		}
 	}
 	if mask := r.getMask16(0x80); mask != 0 { // SOUNDCNT_L
@@ -373,6 +472,15 @@ func (r *IOReg) Commit() {
 			r.APU.FIFOReset(1)
 		}
 	}
+	if mask := r.getMask16(0x84); mask != 0 { // SOUNDCNT_X
+		value := r.readBuffer16(0x84) & mask
+		r.APU.WriteSOUNDCNT_X((r.APU.SOUNDCNT_X & ^mask) | value)
+	}
+	if mask := r.getMask16(0x88); mask != 0 { // SOUNDBIAS
+		mask &= 0xC3FE
+		value := r.readBuffer16(0x88) & mask
+		r.APU.SOUNDBIAS = (r.APU.SOUNDBIAS & ^mask) | value
+	}
 	if mask := r.getMask16(0xA0); mask != 0 { // FIFO_A_L
 		value := r.readBuffer16(0xA0) & mask
 		r.APU.FIFOPush(0, byte(value&0xFF))
@@ -505,8 +613,39 @@ func (r *IOReg) Commit() {
 		value := r.readBuffer16(0x208) & mask
 		r.IRQ.IME = (r.IRQ.IME & ^mask) | value
 	}
+	if mask := r.getMask16(0x204); mask != 0 { // WAITCNT
+		mask &= 0x5FFF
+		value := r.readBuffer16(0x204) & mask
+		r.WAITCNT = (r.WAITCNT & ^mask) | value
+	}
+	if mask := r.getMask8(0x300); mask != 0 { // POSTFLG
+		r.POSTFLG = r.readBuffer8(0x300) & 1
+	}
+	if mask := r.getMask8(0x301); mask != 0 { // HALTCNT
+		if r.readBuffer8(0x301)&0x80 != 0 {
+			r.IRQ.Stopped = true
+		} else {
+			r.IRQ.Halted = true
+		}
+	}
 	r.shouldCommit = false
 	for i := range 0x400 {
 		r.changed[i] = false
 	}
 }
+
+func (r *IOReg) SaveState(w *state.Writer) {
+	w.Write(r.buffer[:])
+	w.Write(r.changed[:])
+	w.Write(r.WAITCNT)
+	w.Write(r.POSTFLG)
+	w.Write(r.shouldCommit)
+}
+
+func (r *IOReg) LoadState(sr *state.Reader) {
+	sr.Read(r.buffer[:])
+	sr.Read(r.changed[:])
+	sr.Read(&r.WAITCNT)
+	sr.Read(&r.POSTFLG)
+	sr.Read(&r.shouldCommit)
+}
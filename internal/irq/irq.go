@@ -1,11 +1,55 @@
 package irq
 
+import "github.com/Div9851/gba-go/internal/state"
+
+// Interrupts that end Stop mode: serial, keypad and Game Pak.
+const stopWakeMask = 1<<7 | 1<<12 | 1<<13
+
 type IRQ struct {
 	IME uint16
 	IE  uint16
 	IF  uint16
+	// Low-power mode entered by writing HALTCNT. Only an interrupt request
+	// ends it, so it lives here.
+	Halted  bool
+	Stopped bool
 }
 
 func NewIRQ() *IRQ {
 	return &IRQ{}
 }
+
+// Wake leaves Halt mode once any enabled interrupt is requested, and Stop
+// mode once a serial, keypad or Game Pak one is; IME does not matter. It
+// reports whether the CPU is running.
+func (irq *IRQ) Wake() bool {
+	switch {
+	case irq.Stopped:
+		if irq.IE&irq.IF&stopWakeMask == 0 {
+			return false
+		}
+	case irq.Halted:
+		if irq.IE&irq.IF == 0 {
+			return false
+		}
+	}
+	irq.Halted = false
+	irq.Stopped = false
+	return true
+}
+
+func (irq *IRQ) SaveState(w *state.Writer) {
+	w.Write(irq.IME)
+	w.Write(irq.IE)
+	w.Write(irq.IF)
+	w.Write(irq.Halted)
+	w.Write(irq.Stopped)
+}
+
+func (irq *IRQ) LoadState(r *state.Reader) {
+	r.Read(&irq.IME)
+	r.Read(&irq.IE)
+	r.Read(&irq.IF)
+	r.Read(&irq.Halted)
+	r.Read(&irq.Stopped)
+}
@@ -7,4 +7,6 @@ type Memory interface {
 	Write16(addr uint32, value uint16)
 	Read32(addr uint32) uint32
 	Write32(addr uint32, value uint32)
+	// AccessCycles returns the cycles of an access of width bytes.
+	AccessCycles(addr uint32, width int, seq bool) int
 }
@@ -3,6 +3,8 @@ package ppu
 import (
 	"github.com/Div9851/gba-go/internal/dma"
 	"github.com/Div9851/gba-go/internal/irq"
+	"github.com/Div9851/gba-go/internal/scheduler"
+	"github.com/Div9851/gba-go/internal/state"
 )
 
 const (
@@ -11,6 +13,7 @@ const (
 	totalScanlines    = 228
 	screenWidth       = 240
 	screenHeight      = 160
+	hdrawCycles       = cyclesPerPixel * screenWidth
 )
 
 type Color struct {
@@ -21,10 +24,11 @@ type Color struct {
 }
 
 type Pixel struct {
-	Color    Color
-	Priority int
-	Layer    int // 0-3: BG 4: OBJ
-	Valid    bool
+	Color           Color
+	Priority        int
+	Layer           int // 0-3: BG 4: OBJ 5: backdrop
+	Valid           bool
+	SemiTransparent bool
 }
 type OAMEntry struct {
 	Y              int
@@ -36,6 +40,8 @@ type OAMEntry struct {
 	Height         int
 	Use256         bool
 	UseRotateScale bool
+	Mode           int // 0: normal 1: semi-transparent 2: OBJ window
+	Mosaic         bool
 
 	// Rotate/Scale used
 	DoubleSize bool
@@ -88,28 +94,46 @@ func (entry *OAMEntry) GetCoordinate(rectX int, rectY int) (spX int, spY int) {
 }
 
 type PPU struct {
-	PRAM        [1024]byte
-	VRAM        [96 * 1024]byte
-	OAM         [1024]byte
-	DISPCNT     uint16
-	DISPSTAT    uint16
-	VCOUNT      uint16
-	BGCNT       [4]uint16
-	BGHOFS      [4]uint16
-	BGVOFS      [4]uint16
-	BGX_L       [4]uint16
-	BGX_H       [4]uint16
-	BGY_L       [4]uint16
-	BGY_H       [4]uint16
-	BG_PA       [4]uint16
-	BG_PB       [4]uint16
-	BG_PC       [4]uint16
-	BG_PD       [4]uint16
-	cycles      uint64
-	frameBuffer [screenHeight * screenWidth * 4]byte
-	OAMEntries  []*OAMEntry
-	IRQ         *irq.IRQ
-	DMA         [4]*dma.Channel
+	PRAM         [1024]byte
+	VRAM         [96 * 1024]byte
+	OAM          [1024]byte
+	DISPCNT      uint16
+	GREENSWAP    uint16
+	DISPSTAT     uint16
+	VCOUNT       uint16
+	BGCNT        [4]uint16
+	BGHOFS       [4]uint16
+	BGVOFS       [4]uint16
+	BGX_L        [4]uint16
+	BGX_H        [4]uint16
+	BGY_L        [4]uint16
+	BGY_H        [4]uint16
+	BG_PA        [4]uint16
+	BG_PB        [4]uint16
+	BG_PC        [4]uint16
+	BG_PD        [4]uint16
+	bgRefX       [4]int32 // internal reference points of the affine BGs
+	bgRefY       [4]int32
+	WINH         [2]uint16
+	WINV         [2]uint16
+	WININ        uint16
+	WINOUT       uint16
+	BLDCNT       uint16
+	BLDALPHA     uint16
+	BLDY         uint16
+	MOSAIC       uint16
+	bgMosaicY    int // scanline the current mosaic block row repeats
+	objMosaicY   int
+	bgMosaicRefX [4]int32 // affine reference points latched on bgMosaicY
+	bgMosaicRefY [4]int32
+	objWindow    [screenWidth]bool // pixels covered by OBJ window sprites
+	oamDirty     bool              // OAM changed since OAMEntries was parsed
+	bgEnableWait [4]int            // scanlines until a newly enabled BG shows
+	frameBuffer  [screenHeight * screenWidth * 4]byte
+	OAMEntries   []*OAMEntry
+	IRQ          *irq.IRQ
+	DMA          [4]*dma.Channel
+	Scheduler    *scheduler.Scheduler
 }
 
 var textBGSizes = [4][2]int{
@@ -137,32 +161,95 @@ var spriteSizes = [4][4][2]int{
 	{{0, 0}, {0, 0}, {0, 0}, {0, 0}},
 }
 
-func NewPPU(irq *irq.IRQ, dma [4]*dma.Channel) *PPU {
-	return &PPU{
-		IRQ: irq,
-		DMA: dma,
+func NewPPU(irq *irq.IRQ, dma [4]*dma.Channel, scheduler *scheduler.Scheduler) *PPU {
+	ppu := &PPU{
+		IRQ:       irq,
+		DMA:       dma,
+		Scheduler: scheduler,
+		oamDirty:  true,
 	}
+	ppu.setupEvents()
+	return ppu
 }
 
-func (ppu *PPU) Step() {
-	ppu.cycles++
+func (ppu *PPU) setupEvents() {
+	ppu.Scheduler.Handle(scheduler.EventHBlank, ppu.HBlank)
+	ppu.Scheduler.Handle(scheduler.EventLineEnd, ppu.LineEnd)
+	ppu.Scheduler.Schedule(scheduler.EventHBlank, hdrawCycles)
+	ppu.Scheduler.Schedule(scheduler.EventLineEnd, cyclesPerScanline)
+}
 
-	if ppu.cycles >= cyclesPerScanline {
-		ppu.cycles -= cyclesPerScanline
+// HBlank draws the scanline that was just scanned out, so register writes
+// made during the previous HBlank (by an HBlank IRQ or DMA) apply to it,
+// then starts the HBlank of this line.
+func (ppu *PPU) HBlank() {
+	if ppu.VCOUNT < screenHeight {
+		ppu.RenderScanline()
+		ppu.AdvanceAffine()
+	}
+	// Sprites are evaluated one scanline ahead of drawing.
+	if ppu.oamDirty {
+		ppu.LoadOAMEntries()
+		ppu.oamDirty = false
+	}
 
-		if ppu.VCOUNT == 0 {
-			ppu.LoadOAMEntries()
+	if (ppu.DISPSTAT & (1 << 4)) != 0 {
+		ppu.IRQ.IF |= 0x2
+	}
+	if ppu.VCOUNT < screenHeight { // no HBlank DMA during VBlank
+		for ch := 0; ch < 4; ch++ {
+			if ppu.DMA[ch].Status == dma.Wait && ppu.DMA[ch].Cond == dma.HBlank {
+				ppu.DMA[ch].Trigger()
+			}
 		}
+	}
+	ppu.DISPSTAT |= 0x2
+}
 
-		if ppu.VCOUNT < screenHeight {
-			ppu.RenderScanline()
-		}
-		ppu.VCOUNT += 1
-		if ppu.VCOUNT >= totalScanlines {
-			ppu.VCOUNT = 0
+// InvalidateOAM makes the sprites be parsed again before the next scanline.
+func (ppu *PPU) InvalidateOAM() {
+	ppu.oamDirty = true
+}
+
+// SetDISPCNT writes DISPCNT. A BG enabled while the screen is being drawn
+// only shows up three scanlines later; disabling is immediate.
+func (ppu *PPU) SetDISPCNT(value uint16) {
+	old := ppu.DISPCNT
+	ppu.DISPCNT = value
+	for bgIndex := 0; bgIndex < 4; bgIndex++ {
+		bit := uint16(1 << (8 + bgIndex))
+		switch {
+		case value&bit == 0:
+			ppu.bgEnableWait[bgIndex] = 0
+		case old&bit == 0 && ppu.VCOUNT < screenHeight && value&(1<<7) == 0:
+			ppu.bgEnableWait[bgIndex] = 3
 		}
 	}
+}
 
+func (ppu *PPU) IsBGEnabled(bgIndex int) bool {
+	return ppu.DISPCNT&(1<<(8+bgIndex)) != 0 && ppu.bgEnableWait[bgIndex] == 0
+}
+
+// IsDrawing reports whether the PPU is fetching from VRAM, PRAM and OAM,
+// which makes CPU and DMA accesses to them wait. They are free during
+// HBlank, VBlank and forced blank.
+func (ppu *PPU) IsDrawing() bool {
+	return ppu.VCOUNT < screenHeight && (ppu.DISPSTAT&0x2) == 0 && (ppu.DISPCNT&(1<<7)) == 0
+}
+
+func (ppu *PPU) LineEnd() {
+	for bgIndex := 0; bgIndex < 4; bgIndex++ {
+		if ppu.bgEnableWait[bgIndex] > 0 {
+			ppu.bgEnableWait[bgIndex]--
+		}
+	}
+	ppu.VCOUNT += 1
+	if ppu.VCOUNT >= totalScanlines {
+		ppu.VCOUNT = 0
+	}
+	ppu.Scheduler.Schedule(scheduler.EventHBlank, hdrawCycles)
+	ppu.Scheduler.Schedule(scheduler.EventLineEnd, cyclesPerScanline)
 	ppu.UpdateDispStat()
 }
 
@@ -178,13 +265,30 @@ func (ppu *PPU) GetColor(paletteIndex int, paletteBaseAddr int) Color {
 	}
 }
 
+// OBJ tiles live in the last 32KB of VRAM. A tile that starts at the end of
+// the area continues from its start.
+const objTileBase = 0x10000
+
+func objVRAMAddr(addr int) int {
+	return objTileBase + (addr-objTileBase)&0x7FFF
+}
+
 func (ppu *PPU) GetTilePixel(tileDataAddr int, x int, y int, palette int, paletteBaseAddr int, use256 bool) Color {
 	var tileColorIndex int
 
+	var addr int
 	if use256 {
-		tileColorIndex = int(ppu.VRAM[tileDataAddr+(y*8+x)])
+		addr = tileDataAddr + (y*8 + x)
 	} else {
-		tileColorIndex = int((ppu.VRAM[tileDataAddr+(y*4+x/2)] >> (4 * (x % 2))) & 0xF)
+		addr = tileDataAddr + (y*4 + x/2)
+	}
+	if tileDataAddr >= objTileBase {
+		addr = objVRAMAddr(addr)
+	}
+	if use256 {
+		tileColorIndex = int(ppu.VRAM[addr])
+	} else {
+		tileColorIndex = int((ppu.VRAM[addr] >> (4 * (x % 2))) & 0xF)
 	}
 
 	if tileColorIndex == 0 {
@@ -201,36 +305,26 @@ func (ppu *PPU) GetTilePixel(tileDataAddr int, x int, y int, palette int, palett
 	return ppu.GetColor(paletteIndex, paletteBaseAddr)
 }
 
+// GetOBJTileDataAddr returns the address of the tile holding pixel (x, y)
+// of a sprite. Tile numbers count 32-byte units from 0x10000, so a 256-color
+// tile spans two of them. With 2D mapping a row of tiles is 32 units wide
+// and the low bit of a 256-color tile number is ignored.
 func (ppu *PPU) GetOBJTileDataAddr(tileIndex int, x int, y int, spriteWidth int, use256 bool) int {
-	var objTileBase int
-	if (ppu.DISPCNT & 0x7) >= 3 { // bitmap mode
-		objTileBase = 0x14000
-	} else { // non-bitmap mode
-		objTileBase = 0x10000
+	unitsPerTile := 1
+	if use256 {
+		unitsPerTile = 2
 	}
 
 	is1DMapping := (ppu.DISPCNT & (1 << 6)) != 0
 
-	var tileDataAddr int
-	var tileSize int
-
-	if use256 {
-		tileSize = 64
-	} else {
-		tileSize = 32
-	}
-
+	var tile int
 	if is1DMapping {
-		currentTile := tileIndex + (y/8)*(spriteWidth/8) + (x / 8)
-		tileDataAddr = objTileBase + currentTile*tileSize
+		tile = tileIndex + ((y/8)*(spriteWidth/8)+(x/8))*unitsPerTile
 	} else {
-		tileX := tileIndex%32 + (x / 8)
-		tileY := tileIndex/32 + (y / 8)
-		currentTile := tileY*32 + tileX
-		tileDataAddr = objTileBase + currentTile*tileSize
+		tile = tileIndex&^(unitsPerTile-1) + (y/8)*32 + (x/8)*unitsPerTile
 	}
 
-	return tileDataAddr
+	return objVRAMAddr(objTileBase + tile*32)
 }
 
 func (ppu *PPU) LoadOAMEntries() {
@@ -258,9 +352,6 @@ func (ppu *PPU) ParseOAMEntry(index int) *OAMEntry {
 
 	use256 := (attr0 & (1 << 13)) != 0
 	tileIndex := int(attr2 & 0x3FF)
-	if use256 {
-		tileIndex /= 2
-	}
 	priority := int((attr2 >> 10) & 0x3)
 	palette := int((attr2 >> 12) & 0xF)
 	shape := int((attr0 >> 14) & 0x3)
@@ -268,6 +359,8 @@ func (ppu *PPU) ParseOAMEntry(index int) *OAMEntry {
 	spriteSize := spriteSizes[shape][size]
 
 	useRotateScale := (attr0 & (1 << 8)) != 0
+	mode := int((attr0 >> 10) & 0x3)
+	mosaic := (attr0 & (1 << 12)) != 0
 
 	if useRotateScale {
 		paramAddr := 0x6 + int((attr1>>9)&0x1F)*0x20
@@ -285,6 +378,8 @@ func (ppu *PPU) ParseOAMEntry(index int) *OAMEntry {
 			Height:         spriteSize[1],
 			Use256:         use256,
 			UseRotateScale: useRotateScale,
+			Mode:           mode,
+			Mosaic:         mosaic,
 			DoubleSize:     (attr0 & (1 << 9)) != 0,
 			PA:             pa,
 			PB:             pb,
@@ -302,6 +397,8 @@ func (ppu *PPU) ParseOAMEntry(index int) *OAMEntry {
 			Height:         spriteSize[1],
 			Use256:         use256,
 			UseRotateScale: useRotateScale,
+			Mode:           mode,
+			Mosaic:         mosaic,
 			HFlip:          (attr1 & (1 << 12)) != 0,
 			VFlip:          (attr1 & (1 << 13)) != 0,
 			Enable:         (attr0 & (1 << 9)) == 0,
@@ -309,68 +406,208 @@ func (ppu *PPU) ParseOAMEntry(index int) *OAMEntry {
 	}
 }
 
-func (ppu *PPU) RenderPixel(pixels [][screenWidth]Pixel, x int, y int) {
-	var finalPixel Pixel
-	highestPriority := 4
-	found := false
-
-	if pixels[4][x].Valid && !pixels[4][x].Color.Transparent {
-		finalPixel = pixels[4][x]
-		highestPriority = pixels[4][x].Priority
-		found = true
+// IsInWindow reports whether pixel (x, y) is inside window 0 or 1. A
+// window whose right (bottom) edge is before its left (top) edge wraps
+// around the screen.
+func (ppu *PPU) IsInWindow(window int, x int, y int) bool {
+	inRange := func(pos int, start int, end int) bool {
+		if start <= end {
+			return start <= pos && pos < end
+		}
+		return pos >= start || pos < end
 	}
+	x1, x2 := int(ppu.WINH[window]>>8), int(ppu.WINH[window]&0xFF)
+	y1, y2 := int(ppu.WINV[window]>>8), int(ppu.WINV[window]&0xFF)
+	return inRange(x, x1, x2) && inRange(y, y1, y2)
+}
 
-	for layer := 0; layer < 4; layer++ {
-		pixel := pixels[layer][x]
-		if pixel.Valid && !pixel.Color.Transparent {
-			if !found || pixel.Priority < highestPriority {
-				finalPixel = pixel
-				highestPriority = pixel.Priority
-				found = true
-			}
+// GetWindowControl returns the WININ/WINOUT byte that applies to pixel
+// (x, y). Bits 0-3 enable BG0-3, bit 4 OBJ and bit 5 color special effects.
+// Window 0 has priority over window 1, which has priority over the OBJ
+// window.
+func (ppu *PPU) GetWindowControl(x int, y int) byte {
+	if (ppu.DISPCNT & 0xE000) == 0 { // no window is enabled
+		return 0x3F
+	}
+	for window := 0; window < 2; window++ {
+		if ppu.DISPCNT&(1<<(13+window)) != 0 && ppu.IsInWindow(window, x, y) {
+			return byte(ppu.WININ>>(8*window)) & 0x3F
 		}
 	}
+	if ppu.DISPCNT&(1<<15) != 0 && ppu.objWindow[x] {
+		return byte(ppu.WINOUT>>8) & 0x3F
+	}
+	return byte(ppu.WINOUT) & 0x3F
+}
 
-	if !found {
-		value := uint16(ppu.PRAM[0]) | (uint16(ppu.PRAM[1]) << 8)
-		r := byte((value & 0x1F) * 255 / 31)
-		g := byte(((value >> 5) & 0x1F) * 255 / 31)
-		b := byte(((value >> 10) & 0x1F) * 255 / 31)
-		finalPixel.Color = Color{
-			R: r,
-			G: g,
-			B: b,
+func (ppu *PPU) RenderPixel(pixels [][screenWidth]Pixel, x int, y int) {
+	control := ppu.GetWindowControl(x, y)
+
+	// Find the two topmost layers. The backdrop (layer 5) is behind all.
+	backdrop := Pixel{
+		Color:    ppu.GetColor(0, 0),
+		Priority: 4,
+		Layer:    5,
+		Valid:    true,
+	}
+	top, second := backdrop, backdrop
+	consider := func(pixel Pixel) {
+		if !pixel.Valid || pixel.Color.Transparent || control&(1<<pixel.Layer) == 0 {
+			return
 		}
+		if pixel.Priority < top.Priority {
+			second = top
+			top = pixel
+		} else if pixel.Priority < second.Priority {
+			second = pixel
+		}
+	}
+	consider(pixels[4][x])
+	for layer := 0; layer < 4; layer++ {
+		consider(pixels[layer][x])
 	}
 
-	ppu.frameBuffer[(y*screenWidth+x)*4] = finalPixel.Color.R
-	ppu.frameBuffer[(y*screenWidth+x)*4+1] = finalPixel.Color.G
-	ppu.frameBuffer[(y*screenWidth+x)*4+2] = finalPixel.Color.B
+	color := top.Color
+	if control&(1<<5) != 0 {
+		color = ppu.ApplyColorEffect(top, second)
+	}
+
+	ppu.frameBuffer[(y*screenWidth+x)*4] = color.R
+	ppu.frameBuffer[(y*screenWidth+x)*4+1] = color.G
+	ppu.frameBuffer[(y*screenWidth+x)*4+2] = color.B
 	ppu.frameBuffer[(y*screenWidth+x)*4+3] = 0xFF
 }
 
+// ApplyColorEffect applies the BLDCNT special effect to the top pixel,
+// blending it with the pixel below for alpha blending. Semi-transparent OBJs
+// are alpha blended whenever the pixel below is a second target.
+func (ppu *PPU) ApplyColorEffect(top Pixel, second Pixel) Color {
+	firstTarget := ppu.BLDCNT&(1<<top.Layer) != 0
+	secondTarget := ppu.BLDCNT&(1<<(8+second.Layer)) != 0
+	if top.SemiTransparent && secondTarget {
+		return ppu.AlphaBlend(top.Color, second.Color)
+	}
+	if !firstTarget {
+		return top.Color
+	}
+	switch (ppu.BLDCNT >> 6) & 0x3 {
+	case 1: // alpha blending
+		if secondTarget {
+			return ppu.AlphaBlend(top.Color, second.Color)
+		}
+	case 2: // brightness increase
+		evy := min(int(ppu.BLDY&0x1F), 16)
+		return mapColor(top.Color, func(c int) int { return c + (255-c)*evy/16 })
+	case 3: // brightness decrease
+		evy := min(int(ppu.BLDY&0x1F), 16)
+		return mapColor(top.Color, func(c int) int { return c - c*evy/16 })
+	}
+	return top.Color
+}
+
+// AlphaBlend mixes two colors with the BLDALPHA coefficients.
+func (ppu *PPU) AlphaBlend(a Color, b Color) Color {
+	eva := min(int(ppu.BLDALPHA&0x1F), 16)
+	evb := min(int((ppu.BLDALPHA>>8)&0x1F), 16)
+	blend := func(ca byte, cb byte) byte {
+		return byte(min((int(ca)*eva+int(cb)*evb)/16, 255))
+	}
+	return Color{
+		R: blend(a.R, b.R),
+		G: blend(a.G, b.G),
+		B: blend(a.B, b.B),
+	}
+}
+
+func mapColor(color Color, f func(c int) int) Color {
+	return Color{
+		R: byte(f(int(color.R))),
+		G: byte(f(int(color.G))),
+		B: byte(f(int(color.B))),
+	}
+}
+
 func (ppu *PPU) RenderScanline() {
 	bgMode := ppu.DISPCNT & 0x7
 	y := int(ppu.VCOUNT)
+	if (ppu.DISPCNT & (1 << 7)) != 0 { // forced blank shows white
+		line := ppu.frameBuffer[y*screenWidth*4 : (y+1)*screenWidth*4]
+		for i := range line {
+			line[i] = 0xFF
+		}
+		return
+	}
 	var pixels [5][screenWidth]Pixel
+	ppu.UpdateMosaic(y)
 	switch bgMode {
 	case 0x0:
 		ppu.RenderMode0Scanline(pixels[:], y)
 	case 0x1:
 		ppu.RenderMode1Scanline(pixels[:], y)
+	case 0x2:
+		ppu.RenderMode2Scanline(pixels[:], y)
 	case 0x3:
 		ppu.RenderMode3Scanline(pixels[:], y)
 	case 0x4:
 		ppu.RenderMode4Scanline(pixels[:], y)
+	case 0x5:
+		ppu.RenderMode5Scanline(pixels[:], y)
+	}
+	for bgIndex := 0; bgIndex < 4; bgIndex++ {
+		if (ppu.BGCNT[bgIndex] & (1 << 6)) != 0 {
+			ppu.ApplyHorizontalMosaic(&pixels[bgIndex], int(ppu.MOSAIC&0xF)+1)
+		}
 	}
 	ppu.RenderOBJScanline(pixels[:], y)
 	for x := 0; x < screenWidth; x++ {
 		ppu.RenderPixel(pixels[:], x, y)
 	}
+	if (ppu.GREENSWAP & 1) != 0 {
+		ppu.SwapGreen(y)
+	}
+}
+
+// SwapGreen exchanges the green components of each pair of pixels, which
+// is what the undocumented GREENSWAP register does.
+func (ppu *PPU) SwapGreen(y int) {
+	line := ppu.frameBuffer[y*screenWidth*4 : (y+1)*screenWidth*4]
+	for x := 0; x < screenWidth; x += 2 {
+		line[x*4+1], line[(x+1)*4+1] = line[(x+1)*4+1], line[x*4+1]
+	}
+}
+
+// UpdateMosaic advances the vertical mosaic counters. Every block row
+// repeats the scanline it started on, counted from the top of the screen.
+func (ppu *PPU) UpdateMosaic(y int) {
+	if y == 0 || y-ppu.bgMosaicY >= int((ppu.MOSAIC>>4)&0xF)+1 {
+		ppu.bgMosaicY = y
+		ppu.bgMosaicRefX = ppu.bgRefX
+		ppu.bgMosaicRefY = ppu.bgRefY
+	}
+	if y == 0 || y-ppu.objMosaicY >= int((ppu.MOSAIC>>12)&0xF)+1 {
+		ppu.objMosaicY = y
+	}
+}
+
+// ApplyHorizontalMosaic stretches the first pixel of every block of size
+// pixels over the whole block.
+func (ppu *PPU) ApplyHorizontalMosaic(line *[screenWidth]Pixel, size int) {
+	for x := 0; x < screenWidth; x++ {
+		line[x] = line[x-x%size]
+	}
+}
+
+// GetAffineRef returns the reference point an affine BG draws the current
+// scanline from.
+func (ppu *PPU) GetAffineRef(bgIndex int) (u int32, v int32) {
+	if (ppu.BGCNT[bgIndex] & (1 << 6)) != 0 {
+		return ppu.bgMosaicRefX[bgIndex], ppu.bgMosaicRefY[bgIndex]
+	}
+	return ppu.bgRefX[bgIndex], ppu.bgRefY[bgIndex]
 }
 
 func (ppu *PPU) RenderTextBGScanline(pixels [][screenWidth]Pixel, bgIndex int, y int) {
-	if ppu.DISPCNT&(1<<(8+bgIndex)) == 0 {
+	if !ppu.IsBGEnabled(bgIndex) {
 		return
 	}
 
@@ -388,6 +625,9 @@ func (ppu *PPU) RenderTextBGScanline(pixels [][screenWidth]Pixel, bgIndex int, y
 	tileDataBaseAddr := int((ppu.BGCNT[bgIndex]>>2)&0x3) * (16 * 1024)
 	tileMapBaseAddr := int((ppu.BGCNT[bgIndex]>>8)&0x1F) * (2 * 1024)
 
+	if (ppu.BGCNT[bgIndex] & (1 << 6)) != 0 {
+		y = ppu.bgMosaicY
+	}
 	bgY := (y + int(ppu.BGVOFS[bgIndex]&0x1FF)) & (bgHeight - 1)
 	for x := 0; x < screenWidth; x++ {
 		bgX := (x + int(ppu.BGHOFS[bgIndex]&0x1FF)) & (bgWidth - 1)
@@ -432,8 +672,33 @@ func (ppu *PPU) RenderTextBGScanline(pixels [][screenWidth]Pixel, bgIndex int, y
 	}
 }
 
+// The affine BGs draw from internal reference points (20.8 fixed point)
+// rather than from BGX/BGY directly. They are reloaded from the registers at
+// VBlank and whenever the registers are written, and advance by PB/PD after
+// every scanline, so writes in the middle of a frame take effect from the
+// next line on.
+
+// ReloadAffineX copies BGX into the internal reference point.
+func (ppu *PPU) ReloadAffineX(bgIndex int) {
+	ppu.bgRefX[bgIndex] = int32(uint32(ppu.BGX_H[bgIndex])<<20|uint32(ppu.BGX_L[bgIndex])<<4) >> 4
+}
+
+// ReloadAffineY copies BGY into the internal reference point.
+func (ppu *PPU) ReloadAffineY(bgIndex int) {
+	ppu.bgRefY[bgIndex] = int32(uint32(ppu.BGY_H[bgIndex])<<20|uint32(ppu.BGY_L[bgIndex])<<4) >> 4
+}
+
+// AdvanceAffine moves the reference points of BG2 and BG3 to the next
+// scanline.
+func (ppu *PPU) AdvanceAffine() {
+	for bgIndex := 2; bgIndex < 4; bgIndex++ {
+		ppu.bgRefX[bgIndex] += int32(int16(ppu.BG_PB[bgIndex]))
+		ppu.bgRefY[bgIndex] += int32(int16(ppu.BG_PD[bgIndex]))
+	}
+}
+
 func (ppu *PPU) RenderRotScaleBGScanline(pixels [][screenWidth]Pixel, bgIndex int, y int) {
-	if ppu.DISPCNT&(1<<(8+bgIndex)) == 0 {
+	if !ppu.IsBGEnabled(bgIndex) {
 		return
 	}
 
@@ -444,22 +709,20 @@ func (ppu *PPU) RenderRotScaleBGScanline(pixels [][screenWidth]Pixel, bgIndex in
 	tileMapBaseAddr := int((ppu.BGCNT[bgIndex]>>8)&0x1F) * (2 * 1024)
 
 	pa := int32(int16(ppu.BG_PA[bgIndex]))
-	pb := int32(int16(ppu.BG_PB[bgIndex]))
 	pc := int32(int16(ppu.BG_PC[bgIndex]))
-	pd := int32(int16(ppu.BG_PD[bgIndex]))
-	baseX := uint32(ppu.BGX_H[bgIndex]&0xFFF)<<16 | uint32(ppu.BGX_L[bgIndex])
-	if baseX&(1<<27) != 0 {
-		baseX |= 0xF0000000
-	}
-	baseY := uint32(ppu.BGY_H[bgIndex]&0xFFF)<<16 | uint32(ppu.BGY_L[bgIndex])
-	if baseY&(1<<27) != 0 {
-		baseY |= 0xF0000000
-	}
-	u := pb*int32(y) + int32(baseX)
-	v := pd*int32(y) + int32(baseY)
+	wrap := (ppu.BGCNT[bgIndex] & (1 << 13)) != 0
+	u, v := ppu.GetAffineRef(bgIndex)
 	for x := 0; x < screenWidth; x++ {
-		bgX := int(u>>8) & (bgWidth - 1)
-		bgY := int(v>>8) & (bgHeight - 1)
+		bgX := int(u >> 8)
+		bgY := int(v >> 8)
+		u += pa
+		v += pc
+		if wrap {
+			bgX &= bgWidth - 1
+			bgY &= bgHeight - 1
+		} else if bgX < 0 || bgX >= bgWidth || bgY < 0 || bgY >= bgHeight {
+			continue // outside of the BG is transparent without wraparound
+		}
 
 		tileMapIndex := (bgY/8)*(bgWidth/8) + (bgX / 8)
 		tileMapAddr := tileMapBaseAddr + tileMapIndex
@@ -476,9 +739,6 @@ func (ppu *PPU) RenderRotScaleBGScanline(pixels [][screenWidth]Pixel, bgIndex in
 			Layer:    bgIndex,
 			Valid:    true,
 		}
-
-		u += pa
-		v += pc
 	}
 }
 
@@ -495,117 +755,197 @@ func (ppu *PPU) RenderMode1Scanline(pixels [][screenWidth]Pixel, y int) {
 	ppu.RenderRotScaleBGScanline(pixels, 2, y)
 }
 
-func (ppu *PPU) RenderMode3Scanline(pixels [][screenWidth]Pixel, y int) {
+func (ppu *PPU) RenderMode2Scanline(pixels [][screenWidth]Pixel, y int) {
+	for bgIndex := 2; bgIndex < 4; bgIndex++ {
+		ppu.RenderRotScaleBGScanline(pixels, bgIndex, y)
+	}
+}
+
+// RenderBitmapScanline draws BG2 of the bitmap modes. The bitmap is mapped
+// through the BG2 rotation/scaling parameters; outside of it BG2 is
+// transparent.
+func (ppu *PPU) RenderBitmapScanline(pixels [][screenWidth]Pixel, y int, width int, height int, getPixel func(bmpX int, bmpY int) Color) {
+	if !ppu.IsBGEnabled(2) {
+		return
+	}
+
+	pa := int32(int16(ppu.BG_PA[2]))
+	pc := int32(int16(ppu.BG_PC[2]))
+	u, v := ppu.GetAffineRef(2)
 	for x := 0; x < screenWidth; x++ {
-		addr := (y*screenWidth + x) * 2
-		value := (uint16(ppu.VRAM[addr+1]) << 8) | uint16(ppu.VRAM[addr])
-		r := byte((value & 0x1F) * 255 / 31)
-		g := byte(((value >> 5) & 0x1F) * 255 / 31)
-		b := byte(((value >> 10) & 0x1F) * 255 / 31)
+		bmpX := int(u >> 8)
+		bmpY := int(v >> 8)
+		u += pa
+		v += pc
+		if bmpX < 0 || bmpX >= width || bmpY < 0 || bmpY >= height {
+			continue
+		}
 		pixels[2][x] = Pixel{
-			Color: Color{
-				R: r,
-				G: g,
-				B: b,
-			},
-			Layer: 2,
-			Valid: true,
+			Color:    getPixel(bmpX, bmpY),
+			Priority: int(ppu.BGCNT[2] & 0x3),
+			Layer:    2,
+			Valid:    true,
 		}
 	}
 }
 
+// GetBitmapColor reads a 15-bit direct color pixel.
+func (ppu *PPU) GetBitmapColor(addr int) Color {
+	value := (uint16(ppu.VRAM[addr+1]) << 8) | uint16(ppu.VRAM[addr])
+	r := byte((value & 0x1F) * 255 / 31)
+	g := byte(((value >> 5) & 0x1F) * 255 / 31)
+	b := byte(((value >> 10) & 0x1F) * 255 / 31)
+	return Color{
+		R: r,
+		G: g,
+		B: b,
+	}
+}
+
+// GetPageBaseAddr returns the frame selected by DISPCNT bit 4 in modes 4
+// and 5.
+func (ppu *PPU) GetPageBaseAddr() int {
+	if ppu.DISPCNT&(1<<4) != 0 {
+		return 0xA000
+	}
+	return 0
+}
+
+func (ppu *PPU) RenderMode3Scanline(pixels [][screenWidth]Pixel, y int) {
+	ppu.RenderBitmapScanline(pixels, y, screenWidth, screenHeight, func(bmpX int, bmpY int) Color {
+		return ppu.GetBitmapColor((bmpY*screenWidth + bmpX) * 2)
+	})
+}
+
 func (ppu *PPU) RenderMode4Scanline(pixels [][screenWidth]Pixel, y int) {
-	for x := 0; x < screenWidth; x++ {
-		addr := y*screenWidth + x
-		paletteIndex := int(ppu.VRAM[addr])
-		pixels[2][x] = Pixel{
-			Color: ppu.GetColor(paletteIndex, 0),
-			Layer: 2,
-			Valid: true,
+	baseAddr := ppu.GetPageBaseAddr()
+	ppu.RenderBitmapScanline(pixels, y, screenWidth, screenHeight, func(bmpX int, bmpY int) Color {
+		paletteIndex := int(ppu.VRAM[baseAddr+bmpY*screenWidth+bmpX])
+		if paletteIndex == 0 {
+			return Color{Transparent: true}
 		}
-	}
+		return ppu.GetColor(paletteIndex, 0)
+	})
+}
+
+func (ppu *PPU) RenderMode5Scanline(pixels [][screenWidth]Pixel, y int) {
+	baseAddr := ppu.GetPageBaseAddr()
+	ppu.RenderBitmapScanline(pixels, y, 160, 128, func(bmpX int, bmpY int) Color {
+		return ppu.GetBitmapColor(baseAddr + (bmpY*160+bmpX)*2)
+	})
 }
 
+// RenderOBJScanline draws the sprites in OAM order. Each scanline has a
+// budget of OBJ rendering cycles, smaller when DISPCNT bit 5 frees the
+// H-Blank interval; sprites beyond it are cut off.
 func (ppu *PPU) RenderOBJScanline(pixels [][screenWidth]Pixel, y int) {
+	ppu.objWindow = [screenWidth]bool{}
 	if (ppu.DISPCNT & (1 << 12)) == 0 {
 		return
 	}
 
+	budget := 1210
+	if (ppu.DISPCNT & (1 << 5)) != 0 {
+		budget = 954
+	}
 	for _, entry := range ppu.OAMEntries {
-		ppu.RenderSprite(pixels, entry, y)
+		if budget <= 0 {
+			break
+		}
+		budget -= ppu.RenderSprite(pixels, entry, y, budget)
 	}
 }
 
-func (ppu *PPU) RenderSprite(pixels [][screenWidth]Pixel, entry *OAMEntry, y int) {
+// RenderSprite draws one scanline of a sprite within the remaining cycle
+// budget and returns the cycles it used: one per pixel, or two per pixel
+// plus 10 for rotation/scaling.
+func (ppu *PPU) RenderSprite(pixels [][screenWidth]Pixel, entry *OAMEntry, y int, budget int) int {
 	if !entry.UseRotateScale && !entry.Enable {
-		return
+		return 0
+	}
+	if entry.Mode == 3 { // prohibited
+		return 0
 	}
 	if y < entry.Y || y >= entry.Y+entry.GetRectHeight() {
-		return
+		return 0
+	}
+
+	cycles, cyclesPerPixel := 0, 1
+	if entry.UseRotateScale {
+		cycles, cyclesPerPixel = 10, 2
 	}
+	// In bitmap modes the lower half of OBJ VRAM belongs to the BG.
+	bitmapMode := (ppu.DISPCNT & 0x7) >= 3
 
 	rectY := y - entry.Y
+	mosaicWidth := 1
+	if entry.Mosaic {
+		rectY = max(ppu.objMosaicY-entry.Y, 0)
+		mosaicWidth = int((ppu.MOSAIC>>8)&0xF) + 1
+	}
 	for rectX := 0; rectX < entry.GetRectWidth(); rectX++ {
+		if cycles+cyclesPerPixel > budget {
+			break
+		}
+		cycles += cyclesPerPixel
+
 		screenX := entry.X + rectX
 		if screenX < 0 || screenX >= screenWidth {
 			continue
 		}
 
-		spX, spY := entry.GetCoordinate(rectX, rectY)
+		// With mosaic the sprite is sampled at the start of each block
+		// of the screen.
+		sampleX := max(rectX-screenX%mosaicWidth, 0)
+		spX, spY := entry.GetCoordinate(sampleX, rectY)
 		if spX < 0 || spX >= entry.Width || spY < 0 || spY >= entry.Height {
 			continue
 		}
 
 		tileDataAddr := ppu.GetOBJTileDataAddr(entry.TileIndex, spX, spY, entry.Width, entry.Use256)
+		if bitmapMode && tileDataAddr < 0x14000 {
+			continue
+		}
 		color := ppu.GetTilePixel(tileDataAddr, spX%8, spY%8, entry.Palette, 0x200, entry.Use256)
 
-		if !color.Transparent {
+		if !color.Transparent && entry.Mode == 2 {
+			ppu.objWindow[screenX] = true
+		} else if !color.Transparent {
 			currentPixel := pixels[4][screenX]
 			if !currentPixel.Valid || currentPixel.Color.Transparent || entry.Priority < currentPixel.Priority {
 				pixels[4][screenX] = Pixel{
-					Color:    color,
-					Priority: entry.Priority,
-					Layer:    4,
-					Valid:    true,
+					Color:           color,
+					Priority:        entry.Priority,
+					Layer:           4,
+					Valid:           true,
+					SemiTransparent: entry.Mode == 1,
 				}
 			}
 		}
 	}
+	return cycles
 }
 
+// UpdateDispStat updates the flags at the start of a scanline.
 func (ppu *PPU) UpdateDispStat() {
-	if ppu.VCOUNT >= screenHeight { // VBLANK
-		if (ppu.DISPSTAT & 0x1) == 0 {
-			if (ppu.DISPSTAT & (1 << 3)) != 0 {
-				ppu.IRQ.IF |= 0x1
-			}
+	ppu.DISPSTAT &= 0xFFFD // HBLANK ends
 
-			for ch := 0; ch < 4; ch++ {
-				if ppu.DMA[ch].Status == dma.Wait && ppu.DMA[ch].Cond == dma.VBlank {
-					ppu.DMA[ch].Trigger()
-				}
+	if ppu.VCOUNT == screenHeight { // VBLANK starts
+		if (ppu.DISPSTAT & (1 << 3)) != 0 {
+			ppu.IRQ.IF |= 0x1
+		}
+		for ch := 0; ch < 4; ch++ {
+			if ppu.DMA[ch].Status == dma.Wait && ppu.DMA[ch].Cond == dma.VBlank {
+				ppu.DMA[ch].Trigger()
 			}
 		}
 		ppu.DISPSTAT |= 0x1
-	} else {
-		ppu.DISPSTAT &= 0xFFFE
-	}
-
-	if ppu.cycles >= cyclesPerPixel*screenWidth { // HBLANK
-		if (ppu.DISPSTAT & 0x2) == 0 {
-			if (ppu.DISPSTAT & (1 << 4)) != 0 {
-				ppu.IRQ.IF |= 0x2
-			}
-
-			for ch := 0; ch < 4; ch++ {
-				if ppu.DMA[ch].Status == dma.Wait && ppu.DMA[ch].Cond == dma.HBlank {
-					ppu.DMA[ch].Trigger()
-				}
-			}
+		for bgIndex := 2; bgIndex < 4; bgIndex++ {
+			ppu.ReloadAffineX(bgIndex)
+			ppu.ReloadAffineY(bgIndex)
 		}
-		ppu.DISPSTAT |= 0x2
-	} else {
-		ppu.DISPSTAT &= 0xFFFD
+	} else if ppu.VCOUNT < screenHeight {
+		ppu.DISPSTAT &= 0xFFFE
 	}
 
 	vcount := (ppu.DISPSTAT >> 8) & 0xFF
@@ -622,3 +962,141 @@ func (ppu *PPU) UpdateDispStat() {
 func (ppu *PPU) GetFrameBuffer() []byte {
 	return ppu.frameBuffer[:]
 }
+
+func (entry *OAMEntry) SaveState(w *state.Writer) {
+	w.WriteInt(entry.Y)
+	w.WriteInt(entry.X)
+	w.WriteInt(entry.TileIndex)
+	w.WriteInt(entry.Priority)
+	w.WriteInt(entry.Palette)
+	w.WriteInt(entry.Width)
+	w.WriteInt(entry.Height)
+	w.Write(entry.Use256)
+	w.Write(entry.UseRotateScale)
+	w.WriteInt(entry.Mode)
+	w.Write(entry.Mosaic)
+	w.Write(entry.DoubleSize)
+	w.Write(entry.PA)
+	w.Write(entry.PB)
+	w.Write(entry.PC)
+	w.Write(entry.PD)
+	w.Write(entry.HFlip)
+	w.Write(entry.VFlip)
+	w.Write(entry.Enable)
+}
+
+func (entry *OAMEntry) LoadState(r *state.Reader) {
+	r.ReadInt(&entry.Y)
+	r.ReadInt(&entry.X)
+	r.ReadInt(&entry.TileIndex)
+	r.ReadInt(&entry.Priority)
+	r.ReadInt(&entry.Palette)
+	r.ReadInt(&entry.Width)
+	r.ReadInt(&entry.Height)
+	r.Read(&entry.Use256)
+	r.Read(&entry.UseRotateScale)
+	r.ReadInt(&entry.Mode)
+	r.Read(&entry.Mosaic)
+	r.Read(&entry.DoubleSize)
+	r.Read(&entry.PA)
+	r.Read(&entry.PB)
+	r.Read(&entry.PC)
+	r.Read(&entry.PD)
+	r.Read(&entry.HFlip)
+	r.Read(&entry.VFlip)
+	r.Read(&entry.Enable)
+}
+
+func (ppu *PPU) SaveState(w *state.Writer) {
+	w.Write(ppu.PRAM[:])
+	w.Write(ppu.VRAM[:])
+	w.Write(ppu.OAM[:])
+	w.Write(ppu.DISPCNT)
+	w.Write(ppu.GREENSWAP)
+	w.Write(ppu.DISPSTAT)
+	w.Write(ppu.VCOUNT)
+	w.Write(ppu.BGCNT[:])
+	w.Write(ppu.BGHOFS[:])
+	w.Write(ppu.BGVOFS[:])
+	w.Write(ppu.BGX_L[:])
+	w.Write(ppu.BGX_H[:])
+	w.Write(ppu.BGY_L[:])
+	w.Write(ppu.BGY_H[:])
+	w.Write(ppu.BG_PA[:])
+	w.Write(ppu.BG_PB[:])
+	w.Write(ppu.BG_PC[:])
+	w.Write(ppu.BG_PD[:])
+	w.Write(ppu.bgRefX[:])
+	w.Write(ppu.bgRefY[:])
+	w.Write(ppu.WINH[:])
+	w.Write(ppu.WINV[:])
+	w.Write(ppu.WININ)
+	w.Write(ppu.WINOUT)
+	w.Write(ppu.BLDCNT)
+	w.Write(ppu.BLDALPHA)
+	w.Write(ppu.BLDY)
+	w.Write(ppu.MOSAIC)
+	w.WriteInt(ppu.bgMosaicY)
+	w.WriteInt(ppu.objMosaicY)
+	w.Write(ppu.bgMosaicRefX[:])
+	w.Write(ppu.bgMosaicRefY[:])
+	w.Write(ppu.oamDirty)
+	for _, wait := range ppu.bgEnableWait {
+		w.WriteInt(wait)
+	}
+	w.WriteInt(len(ppu.OAMEntries))
+	for _, entry := range ppu.OAMEntries {
+		entry.SaveState(w)
+	}
+}
+
+func (ppu *PPU) LoadState(r *state.Reader) {
+	r.Read(ppu.PRAM[:])
+	r.Read(ppu.VRAM[:])
+	r.Read(ppu.OAM[:])
+	r.Read(&ppu.DISPCNT)
+	r.Read(&ppu.GREENSWAP)
+	r.Read(&ppu.DISPSTAT)
+	r.Read(&ppu.VCOUNT)
+	r.Read(ppu.BGCNT[:])
+	r.Read(ppu.BGHOFS[:])
+	r.Read(ppu.BGVOFS[:])
+	r.Read(ppu.BGX_L[:])
+	r.Read(ppu.BGX_H[:])
+	r.Read(ppu.BGY_L[:])
+	r.Read(ppu.BGY_H[:])
+	r.Read(ppu.BG_PA[:])
+	r.Read(ppu.BG_PB[:])
+	r.Read(ppu.BG_PC[:])
+	r.Read(ppu.BG_PD[:])
+	r.Read(ppu.bgRefX[:])
+	r.Read(ppu.bgRefY[:])
+	r.Read(ppu.WINH[:])
+	r.Read(ppu.WINV[:])
+	r.Read(&ppu.WININ)
+	r.Read(&ppu.WINOUT)
+	r.Read(&ppu.BLDCNT)
+	r.Read(&ppu.BLDALPHA)
+	r.Read(&ppu.BLDY)
+	r.Read(&ppu.MOSAIC)
+	r.ReadInt(&ppu.bgMosaicY)
+	r.ReadInt(&ppu.objMosaicY)
+	r.Read(ppu.bgMosaicRefX[:])
+	r.Read(ppu.bgMosaicRefY[:])
+	r.Read(&ppu.oamDirty)
+	for i := range ppu.bgEnableWait {
+		r.ReadInt(&ppu.bgEnableWait[i])
+	}
+	var count int
+	r.ReadInt(&count)
+	if count < 0 || count > 128 {
+		r.Fail(state.ErrInvalidLength)
+		return
+	}
+	ppu.OAMEntries = ppu.OAMEntries[:0]
+	for i := 0; i < count; i++ {
+		entry := &OAMEntry{}
+		entry.LoadState(r)
+		ppu.OAMEntries = append(ppu.OAMEntries, entry)
+	}
+}
@@ -0,0 +1,61 @@
+package ppu
+
+import (
+	"testing"
+
+	"github.com/Div9851/gba-go/internal/dma"
+	"github.com/Div9851/gba-go/internal/irq"
+	"github.com/Div9851/gba-go/internal/scheduler"
+)
+
+func TestOBJTileWrapsAtEndOfVRAM(t *testing.T) {
+	tests := []struct {
+		name       string
+		mapping1D  bool
+		tile       int
+		use256     bool
+		wantAddr   int
+		wrapsAtRow int // first row read from the start of OBJ VRAM
+	}{
+		{"256 colors, 1D", true, 0x3FF, true, 0x17FE0, 4},
+		{"256 colors, 2D", false, 0x3FF, true, 0x17FC0, 8},
+		{"16 colors, 1D", true, 0x3FF, false, 0x17FE0, 8},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ppu := NewPPU(irq.NewIRQ(), [4]*dma.Channel{}, scheduler.NewScheduler())
+			if tt.mapping1D {
+				ppu.DISPCNT = 1 << 6
+			}
+			for i := 0x10000; i < len(ppu.VRAM); i++ {
+				ppu.VRAM[i] = 0x11
+			}
+			for i := 0x10000; i < 0x10020; i++ {
+				ppu.VRAM[i] = 0x22
+			}
+			for i := 0; i < 0x200; i += 2 {
+				ppu.PRAM[0x200+i] = byte(i / 2) // distinct red levels
+			}
+
+			addr := ppu.GetOBJTileDataAddr(tt.tile, 0, 0, 8, tt.use256)
+			if addr != tt.wantAddr {
+				t.Fatalf("tile address = %#x, want %#x", addr, tt.wantAddr)
+			}
+			for y := 0; y < 8; y++ {
+				for x := 0; x < 8; x++ {
+					index := 0x11
+					if y >= tt.wrapsAtRow {
+						index = 0x22
+					}
+					if !tt.use256 {
+						index &= 0xF
+					}
+					want := ppu.GetColor(index, 0x200)
+					if got := ppu.GetTilePixel(addr, x, y, 0, 0x200, tt.use256); got != want {
+						t.Errorf("pixel (%d, %d) = %+v, want %+v", x, y, got, want)
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,129 @@
+package scheduler
+
+import (
+	"math"
+
+	"github.com/Div9851/gba-go/internal/state"
+)
+
+// Each kind has at most one pending event. Handlers are registered by the
+// components at construction, so a save state only stores (kind, time).
+const (
+	EventHBlank = iota
+	EventLineEnd
+	EventTimer0
+	EventTimer1
+	EventTimer2
+	EventTimer3
+	EventAPUSample
+	EventAPUFrame
+	EventDMA0
+	EventDMA1
+	EventDMA2
+	EventDMA3
+	NumEvents
+)
+
+type Scheduler struct {
+	now      uint64
+	next     uint64
+	times    [NumEvents]uint64
+	pending  [NumEvents]bool
+	handlers [NumEvents]func()
+}
+
+func NewScheduler() *Scheduler {
+	return &Scheduler{
+		next: math.MaxUint64,
+	}
+}
+
+// Now returns the current cycle. Inside a handler it is the time the event
+// was scheduled for.
+func (s *Scheduler) Now() uint64 {
+	return s.now
+}
+
+// NextEvent returns the time of the earliest pending event.
+func (s *Scheduler) NextEvent() uint64 {
+	return s.next
+}
+
+func (s *Scheduler) Handle(kind int, handler func()) {
+	s.handlers[kind] = handler
+}
+
+// Schedule replaces any pending event of the kind with one that fires
+// after the given number of cycles.
+func (s *Scheduler) Schedule(kind int, cycles int) {
+	s.ScheduleAt(kind, s.now+uint64(cycles))
+}
+
+func (s *Scheduler) ScheduleAt(kind int, time uint64) {
+	s.times[kind] = time
+	s.pending[kind] = true
+	if time < s.next {
+		s.next = time
+	} else {
+		s.updateNext()
+	}
+}
+
+func (s *Scheduler) Cancel(kind int) {
+	if !s.pending[kind] {
+		return
+	}
+	s.pending[kind] = false
+	s.updateNext()
+}
+
+func (s *Scheduler) Pending(kind int) bool {
+	return s.pending[kind]
+}
+
+// When returns the time of the pending event of the kind.
+func (s *Scheduler) When(kind int) uint64 {
+	return s.times[kind]
+}
+
+func (s *Scheduler) updateNext() {
+	s.next = math.MaxUint64
+	for kind := range NumEvents {
+		if s.pending[kind] && s.times[kind] < s.next {
+			s.next = s.times[kind]
+		}
+	}
+}
+
+// Advance moves time forward and runs the events that become due, in time
+// order.
+func (s *Scheduler) Advance(cycles int) {
+	target := s.now + uint64(cycles)
+	for s.next <= target {
+		kind := 0
+		for k := range NumEvents {
+			if s.pending[k] && s.times[k] == s.next {
+				kind = k
+				break
+			}
+		}
+		s.now = s.next
+		s.pending[kind] = false
+		s.updateNext()
+		s.handlers[kind]()
+	}
+	s.now = target
+}
+
+func (s *Scheduler) SaveState(w *state.Writer) {
+	w.Write(s.now)
+	w.Write(s.times[:])
+	w.Write(s.pending[:])
+}
+
+func (s *Scheduler) LoadState(r *state.Reader) {
+	r.Read(&s.now)
+	r.Read(s.times[:])
+	r.Read(s.pending[:])
+	s.updateNext()
+}
@@ -0,0 +1,99 @@
+package state
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+const maxBytesLength = 64 * 1024 * 1024
+
+var (
+	ErrInvalidLength = errors.New("state: invalid length")
+	// ErrInvalidValue reports a field out of the range the component can
+	// produce, which only a corrupt stream has.
+	ErrInvalidValue = errors.New("state: invalid value")
+)
+
+// Writer serializes component state in little-endian order.
+// The first error is kept and every later write becomes a no-op.
+type Writer struct {
+	w   io.Writer
+	err error
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+func (s *Writer) Write(data any) {
+	if s.err != nil {
+		return
+	}
+	s.err = binary.Write(s.w, binary.LittleEndian, data)
+}
+
+func (s *Writer) WriteInt(value int) {
+	s.Write(int64(value))
+}
+
+func (s *Writer) WriteBytes(data []byte) {
+	s.WriteInt(len(data))
+	s.Write(data)
+}
+
+func (s *Writer) Err() error {
+	return s.err
+}
+
+// Reader is the counterpart of Writer.
+type Reader struct {
+	r   io.Reader
+	err error
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: r}
+}
+
+func (s *Reader) Read(data any) {
+	if s.err != nil {
+		return
+	}
+	s.err = binary.Read(s.r, binary.LittleEndian, data)
+}
+
+func (s *Reader) ReadInt(value *int) {
+	var v int64
+	s.Read(&v)
+	if s.err == nil {
+		*value = int(v)
+	}
+}
+
+func (s *Reader) ReadBytes() []byte {
+	var length int
+	s.ReadInt(&length)
+	if s.err != nil {
+		return nil
+	}
+	if length < 0 || length > maxBytesLength {
+		s.err = ErrInvalidLength
+		return nil
+	}
+	data := make([]byte, length)
+	s.Read(data)
+	return data
+}
+
+// Fail records err as the reader error unless there already is one, for
+// values that were read fine but make no sense.
+func (s *Reader) Fail(err error) {
+	if s.err == nil {
+		s.err = err
+	}
+}
+
+func (s *Reader) Err() error {
+	return s.err
+}
@@ -3,24 +3,70 @@ package timer
 import (
 	"github.com/Div9851/gba-go/internal/apu"
 	"github.com/Div9851/gba-go/internal/irq"
+	"github.com/Div9851/gba-go/internal/scheduler"
+	"github.com/Div9851/gba-go/internal/state"
 )
 
+var prescalerShifts = [4]uint{0, 6, 8, 10} // 1, 64, 256, 1024 cycles
+
+// The counter is not stepped. It is computed from the cycles elapsed since
+// startTime, and the overflow is scheduled ahead of time.
 type Timer struct {
-	index   int
-	TMCNT_L uint16
-	TMCNT_H uint16
-	reload  uint16
-	IRQ     *irq.IRQ
-	APU     *apu.APU
-	cycles  int
-	Next    *Timer
+	index     int
+	TMCNT_L   uint16 // counter value at startTime
+	TMCNT_H   uint16
+	reload    uint16
+	startTime uint64
+	IRQ       *irq.IRQ
+	APU       *apu.APU
+	Scheduler *scheduler.Scheduler
+	Next      *Timer
 }
 
-func NewTimer(index int, irq *irq.IRQ, apu *apu.APU) *Timer {
-	return &Timer{
-		IRQ: irq,
-		APU: apu,
+func NewTimer(index int, irq *irq.IRQ, apu *apu.APU, scheduler *scheduler.Scheduler) *Timer {
+	tm := &Timer{
+		index:     index,
+		IRQ:       irq,
+		APU:       apu,
+		Scheduler: scheduler,
 	}
+	scheduler.Handle(tm.event(), tm.overflow)
+	return tm
+}
+
+func (tm *Timer) event() int {
+	return scheduler.EventTimer0 + tm.index
+}
+
+func (tm *Timer) running() bool {
+	return (tm.TMCNT_H&(1<<7)) != 0 && (tm.TMCNT_H&(1<<2)) == 0
+}
+
+// sync folds the elapsed cycles into TMCNT_L, keeping the prescaler phase.
+func (tm *Timer) sync() {
+	if !tm.running() {
+		return
+	}
+	shift := prescalerShifts[tm.TMCNT_H&0x3]
+	ticks := (tm.Scheduler.Now() - tm.startTime) >> shift
+	tm.TMCNT_L += uint16(ticks)
+	tm.startTime += ticks << shift
+}
+
+func (tm *Timer) schedule() {
+	if !tm.running() {
+		tm.Scheduler.Cancel(tm.event())
+		return
+	}
+	shift := prescalerShifts[tm.TMCNT_H&0x3]
+	ticks := 0x10000 - uint64(tm.TMCNT_L)
+	tm.Scheduler.ScheduleAt(tm.event(), tm.startTime+ticks<<shift)
+}
+
+// Counter returns the current counter value.
+func (tm *Timer) Counter() uint16 {
+	tm.sync()
+	return tm.TMCNT_L
 }
 
 func (tm *Timer) SetTMCNT_L(value uint16) {
@@ -28,51 +74,55 @@ func (tm *Timer) SetTMCNT_L(value uint16) {
 }
 
 func (tm *Timer) SetTMCNT_H(value uint16) {
+	tm.sync()
 	oldValue := tm.TMCNT_H
 	tm.TMCNT_H = value
 	if (oldValue&(1<<7)) == 0 && (value&(1<<7)) != 0 { // start
-		tm.cycles = 0
 		tm.TMCNT_L = tm.reload
 	}
+	tm.startTime = tm.Scheduler.Now()
+	tm.schedule()
 }
 
-func (tm *Timer) Step() {
-	if (tm.TMCNT_H&(1<<7)) == 0 || (tm.TMCNT_H&(1<<2)) != 0 {
-		return
-	}
-
-	var prescaler int
-	switch tm.TMCNT_H & 0x3 {
-	case 0x0:
-		prescaler = 1
-	case 0x1:
-		prescaler = 64
-	case 0x2:
-		prescaler = 256
-	case 0x3:
-		prescaler = 1024
-	}
-
-	tm.cycles++
-	if tm.cycles >= prescaler {
-		tm.cycles = 0
-		tm.Tick()
-	}
+func (tm *Timer) overflow() {
+	tm.TMCNT_L = tm.reload
+	tm.startTime = tm.Scheduler.Now()
+	tm.raise()
+	tm.schedule()
 }
 
+// Tick counts one step of a cascaded timer.
 func (tm *Timer) Tick() {
 	if tm.TMCNT_L == 0xFFFF {
-		if (tm.TMCNT_H & (1 << 6)) != 0 {
-			tm.IRQ.IF |= 1 << (3 + tm.index)
-		}
-		if 0 <= tm.index && tm.index <= 1 {
-			tm.APU.TimerTick(tm.index)
-		}
 		tm.TMCNT_L = tm.reload
-		if tm.Next != nil && (tm.Next.TMCNT_H&(1<<2)) != 0 {
-			tm.Next.Tick()
-		}
+		tm.raise()
 	} else {
 		tm.TMCNT_L++
 	}
 }
+
+func (tm *Timer) raise() {
+	if (tm.TMCNT_H & (1 << 6)) != 0 {
+		tm.IRQ.IF |= 1 << (3 + tm.index)
+	}
+	if 0 <= tm.index && tm.index <= 1 {
+		tm.APU.TimerTick(tm.index)
+	}
+	if tm.Next != nil && (tm.Next.TMCNT_H&(1<<7)) != 0 && (tm.Next.TMCNT_H&(1<<2)) != 0 {
+		tm.Next.Tick()
+	}
+}
+
+func (tm *Timer) SaveState(w *state.Writer) {
+	w.Write(tm.TMCNT_L)
+	w.Write(tm.TMCNT_H)
+	w.Write(tm.reload)
+	w.Write(tm.startTime)
+}
+
+func (tm *Timer) LoadState(r *state.Reader) {
+	r.Read(&tm.TMCNT_L)
+	r.Read(&tm.TMCNT_H)
+	r.Read(&tm.reload)
+	r.Read(&tm.startTime)
+}
@@ -0,0 +1,156 @@
+package emulator
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// Wait this many frames without backup writes before writing the
+	// .sav file, so a game that saves in several steps is written once.
+	autosaveDelayFrames = 60
+)
+
+func (gba *GBA) loadBackup() error {
+	if gba.SavePath == "" {
+		return nil
+	}
+	data, err := os.ReadFile(gba.SavePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := gba.Bus.GamePak.Backup.Import(data); err != nil {
+		return fmt.Errorf("%s: %w", gba.SavePath, err)
+	}
+	gba.Bus.GamePak.Backup.ClearDirty()
+	return nil
+}
+
+// rtcPath is the sidecar file holding the real-time clock offset, next to
+// the .sav file.
+func (gba *GBA) rtcPath() string {
+	return strings.TrimSuffix(gba.SavePath, filepath.Ext(gba.SavePath)) + ".rtc"
+}
+
+func (gba *GBA) loadRTC() error {
+	rtc := gba.Bus.GamePak.RTC
+	if rtc == nil {
+		return nil
+	}
+	rtc.Offset = gba.RTCOffset
+	if gba.SavePath == "" {
+		return nil
+	}
+	data, err := os.ReadFile(gba.rtcPath())
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(data) != 8 {
+		return errors.New("invalid rtc file")
+	}
+	rtc.Offset = time.Duration(int64(binary.LittleEndian.Uint64(data))) * time.Second
+	return nil
+}
+
+func (gba *GBA) backupDirty() bool {
+	dirty := false
+	if backup := gba.Bus.GamePak.Backup; backup.Dirty() {
+		backup.ClearDirty()
+		dirty = true
+	}
+	if rtc := gba.Bus.GamePak.RTC; rtc != nil && rtc.Dirty() {
+		rtc.ClearDirty()
+		dirty = true
+	}
+	return dirty
+}
+
+func (gba *GBA) updateAutosave() {
+	if gba.Bus.GamePak == nil || gba.SavePath == "" {
+		return
+	}
+	if gba.backupDirty() {
+		gba.savePending = true
+		gba.saveIdleFrames = 0
+		return
+	}
+	if !gba.savePending {
+		return
+	}
+	gba.saveIdleFrames++
+	if gba.saveIdleFrames >= autosaveDelayFrames {
+		if err := gba.FlushSave(); err != nil {
+			log.Printf("autosave: %v", err)
+			gba.saveIdleFrames = 0
+		}
+	}
+}
+
+// FlushSave writes the backup device contents to SavePath, and the clock
+// offset of an RTC cartridge next to it, if they changed since the last
+// write. The files are replaced atomically.
+func (gba *GBA) FlushSave() error {
+	if gba.Bus.GamePak == nil || gba.SavePath == "" {
+		return nil
+	}
+	if gba.backupDirty() {
+		gba.savePending = true
+	}
+	if !gba.savePending {
+		return nil
+	}
+	if data := gba.Bus.GamePak.Backup.Export(); len(data) > 0 {
+		if err := writeFileAtomic(gba.SavePath, data); err != nil {
+			return err
+		}
+	}
+	if rtc := gba.Bus.GamePak.RTC; rtc != nil {
+		data := binary.LittleEndian.AppendUint64(nil, uint64(rtc.Offset/time.Second))
+		if err := writeFileAtomic(gba.rtcPath(), data); err != nil {
+			return err
+		}
+	}
+	gba.savePending = false
+	gba.saveIdleFrames = 0
+	return nil
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	tmpPath := f.Name()
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
@@ -1,6 +1,12 @@
 package emulator
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
 	"github.com/Div9851/gba-go/internal/apu"
 	"github.com/Div9851/gba-go/internal/bus"
 	"github.com/Div9851/gba-go/internal/cpu"
@@ -10,6 +16,8 @@ import (
 	"github.com/Div9851/gba-go/internal/ioreg"
 	"github.com/Div9851/gba-go/internal/irq"
 	"github.com/Div9851/gba-go/internal/ppu"
+	"github.com/Div9851/gba-go/internal/scheduler"
+	"github.com/Div9851/gba-go/internal/state"
 	"github.com/Div9851/gba-go/internal/timer"
 )
 
@@ -17,32 +25,108 @@ const (
 	cyclesPerFrame = 280896
 )
 
+const (
+	stateMagic   = "GBAS"
+	stateVersion = 19
+)
+
+var ErrInvalidState = errors.New("emulator: not a save state")
+
+type SaveType = gamepak.SaveType
+
+const (
+	SaveTypeAuto      = gamepak.SaveTypeAuto
+	SaveTypeNone      = gamepak.SaveTypeNone
+	SaveTypeSRAM      = gamepak.SaveTypeSRAM
+	SaveTypeEEPROM    = gamepak.SaveTypeEEPROM
+	SaveTypeEEPROM512 = gamepak.SaveTypeEEPROM512
+	SaveTypeEEPROM8K  = gamepak.SaveTypeEEPROM8K
+	SaveTypeFlash64K  = gamepak.SaveTypeFlash64K
+	SaveTypeFlash128K = gamepak.SaveTypeFlash128K
+
+	SaveTypeFlash64KAtmel     = gamepak.SaveTypeFlash64KAtmel
+	SaveTypeFlash64KMacronix  = gamepak.SaveTypeFlash64KMacronix
+	SaveTypeFlash128KMacronix = gamepak.SaveTypeFlash128KMacronix
+)
+
+func ParseSaveType(name string) (SaveType, error) {
+	return gamepak.ParseSaveType(name)
+}
+
+type BootMode int
+
+const (
+	// BootDirect starts the cartridge at 0x08000000 with the state the
+	// BIOS would leave behind.
+	BootDirect BootMode = iota
+	// BootBIOS runs the BIOS from the reset vector, including the intro.
+	BootBIOS
+)
+
+func (mode BootMode) String() string {
+	switch mode {
+	case BootDirect:
+		return "direct"
+	case BootBIOS:
+		return "bios"
+	}
+	return fmt.Sprintf("BootMode(%d)", int(mode))
+}
+
+func ParseBootMode(name string) (BootMode, error) {
+	for _, mode := range []BootMode{BootDirect, BootBIOS} {
+		if mode.String() == name {
+			return mode, nil
+		}
+	}
+	return BootDirect, fmt.Errorf("unknown boot mode %q", name)
+}
+
 type GBA struct {
-	CPU    *cpu.CPU
-	Bus    *bus.Bus
-	PPU    *ppu.PPU
-	APU    *apu.APU
-	DMA    [4]*dma.Channel
-	Input  *input.Input
-	Timers [4]*timer.Timer
+	CPU       *cpu.CPU
+	Bus       *bus.Bus
+	PPU       *ppu.PPU
+	APU       *apu.APU
+	DMA       [4]*dma.Channel
+	Input     *input.Input
+	Timers    [4]*timer.Timer
+	Scheduler *scheduler.Scheduler
 
-	running bool
+	// SavePath is the battery save (.sav) file. It is read by LoadROM and
+	// written back by the autosave and FlushSave. Empty disables it.
+	SavePath string
+	// SaveType forces the backup device used by LoadROM. SaveTypeAuto
+	// detects it from the ROM.
+	SaveType SaveType
+	// RTCOffset shifts the cartridge clock from the host clock. It is
+	// used until the game sets the clock; after that the offset is kept
+	// in a .rtc file next to SavePath.
+	RTCOffset time.Duration
+	// BootMode selects how Start boots. BootBIOS needs a real BIOS dump;
+	// with the HLE BIOS the cartridge is always booted directly.
+	BootMode BootMode
+
+	running        bool
+	frameEnd       uint64
+	savePending    bool
+	saveIdleFrames int
 }
 
 func NewGBA() *GBA {
+	scheduler := scheduler.NewScheduler()
 	bus := bus.NewBus()
 	irq := irq.NewIRQ()
 	cpu := cpu.NewCPU(bus, irq)
 	dmaChannels := [4]*dma.Channel{}
 	for i := 0; i < 4; i++ {
-		dmaChannels[i] = dma.NewChannel(i, bus, irq)
+		dmaChannels[i] = dma.NewChannel(i, bus, irq, scheduler)
 	}
-	ppu := ppu.NewPPU(irq, dmaChannels)
-	apu := apu.NewAPU(dmaChannels)
+	ppu := ppu.NewPPU(irq, dmaChannels, scheduler)
+	apu := apu.NewAPU(dmaChannels, scheduler)
 	input := input.NewInput(irq)
 	timers := [4]*timer.Timer{}
 	for i := 3; i >= 0; i-- {
-		timers[i] = timer.NewTimer(i, irq, apu)
+		timers[i] = timer.NewTimer(i, irq, apu, scheduler)
 		if i < 3 {
 			timers[i].Next = timers[i+1]
 		}
@@ -52,65 +136,90 @@ func NewGBA() *GBA {
 	bus.Setup(ppu, ioReg)
 
 	gba := &GBA{
-		CPU:     cpu,
-		Bus:     bus,
-		PPU:     ppu,
-		APU:     apu,
-		DMA:     dmaChannels,
-		Input:   input,
-		Timers:  timers,
-		running: false,
+		CPU:       cpu,
+		Bus:       bus,
+		PPU:       ppu,
+		APU:       apu,
+		DMA:       dmaChannels,
+		Input:     input,
+		Timers:    timers,
+		Scheduler: scheduler,
+		running:   false,
 	}
 
 	return gba
 }
 
 func (gba *GBA) Start() {
+	if gba.BootMode == BootBIOS && !gba.CPU.HLE {
+		gba.CPU.Reset()
+	} else {
+		gba.directBoot()
+	}
 	gba.CPU.ResetPipeline()
 	gba.running = true
 }
 
+func (gba *GBA) directBoot() {
+	gba.CPU.DirectBoot()
+	gba.CPU.RegisterRamReset(0xFF)
+	for addr := uint32(0x3007E00); addr < 0x3008000; addr += 4 {
+		gba.Bus.Write32(addr, 0)
+	}
+	gba.Bus.Write16(0x4000088, 0x200) // SOUNDBIAS
+	gba.Bus.Write8(0x4000300, 1)      // POSTFLG
+}
+
 func (gba *GBA) Stop() {
 	gba.running = false
 }
 
 func (gba *GBA) LoadBIOS(data []byte) {
 	gba.Bus.LoadBIOS(data)
+	gba.CPU.HLE = false
+}
+
+// UseHLEBIOS runs without a BIOS dump: SWI calls are emulated natively and
+// the BIOS area only holds the IRQ vector stub.
+func (gba *GBA) UseHLEBIOS() {
+	gba.Bus.LoadBIOS(cpu.HLEBIOS())
+	gba.CPU.HLE = true
 }
 
-func (gba *GBA) LoadROM(data []byte) {
-	gba.Bus.GamePak = gamepak.NewGamePak(data)
+func (gba *GBA) LoadROM(data []byte) error {
+	gba.Bus.GamePak = gamepak.NewGamePak(data, gba.SaveType)
+	gba.savePending = false
+	gba.saveIdleFrames = 0
+	if err := gba.loadBackup(); err != nil {
+		return err
+	}
+	return gba.loadRTC()
 }
 
+// Step runs one CPU instruction, or one DMA transfer while a channel is
+// triggered, then the events that became due. A halted CPU skips ahead to
+// the next event; in Stop mode nothing runs at all.
 func (gba *GBA) Step() {
-	activeDMAChannel := -1
-	for ch := 0; ch < 4; ch++ {
-		if gba.DMA[ch].Status == dma.Active {
-			activeDMAChannel = ch
-			break
+	var cycles int
+	if ch := gba.triggeredDMA(); ch != nil {
+		cycles = ch.Run()
+	} else if cycles = gba.CPU.Step(); cycles == 0 {
+		if gba.CPU.IRQ.Stopped {
+			return
 		}
+		// Only an event can request an interrupt while halted.
+		cycles = int(gba.Scheduler.NextEvent() - gba.Scheduler.Now())
 	}
-	if activeDMAChannel == -1 {
-		gba.CPU.Step()
-		for ch := 0; ch < 4; ch++ {
-			if gba.DMA[ch].Status == dma.Wait && gba.DMA[ch].Cond == dma.Immediate {
-				gba.DMA[ch].Trigger()
-			}
-		}
-		for ch := 0; ch < 4; ch++ {
-			if gba.DMA[ch].Status == dma.Triggered {
-				gba.DMA[ch].Status = dma.Active
-				break
-			}
+	gba.Scheduler.Advance(cycles)
+}
+
+func (gba *GBA) triggeredDMA() *dma.Channel {
+	for ch := 0; ch < 4; ch++ {
+		if gba.DMA[ch].Status == dma.Triggered {
+			return gba.DMA[ch]
 		}
-	} else {
-		gba.DMA[activeDMAChannel].Step()
-	}
-	gba.PPU.Step()
-	gba.APU.Step()
-	for i := 0; i < 4; i++ {
-		gba.Timers[i].Step()
 	}
+	return nil
 }
 
 func (gba *GBA) Update(keys []string) {
@@ -118,7 +227,105 @@ func (gba *GBA) Update(keys []string) {
 		return
 	}
 	gba.Input.SetKeys(keys)
-	for i := 0; i < cyclesPerFrame; i++ {
+	gba.frameEnd += cyclesPerFrame
+	if gba.frameEnd <= gba.Scheduler.Now() {
+		gba.frameEnd = gba.Scheduler.Now() + cyclesPerFrame
+	}
+	for gba.Scheduler.Now() < gba.frameEnd {
 		gba.Step()
+		if gba.CPU.IRQ.Stopped {
+			// Frozen until a key press wakes it up in a later frame.
+			gba.frameEnd = gba.Scheduler.Now()
+			break
+		}
+	}
+	gba.updateAutosave()
+}
+
+// SaveState writes a snapshot of the whole machine. Of the cartridge only
+// the backup and RTC transfers in progress are included, not the ROM, the
+// backup contents or the clock offset.
+func (gba *GBA) SaveState(w io.Writer) error {
+	sw := state.NewWriter(w)
+	sw.Write([]byte(stateMagic))
+	sw.Write(uint32(stateVersion))
+	gba.saveState(sw)
+	return sw.Err()
+}
+
+// SaveStateFile writes a snapshot to path. The previous file is replaced
+// only once the new snapshot is complete.
+func (gba *GBA) SaveStateFile(path string) error {
+	var buf bytes.Buffer
+	if err := gba.SaveState(&buf); err != nil {
+		return err
+	}
+	return writeFileAtomic(path, buf.Bytes())
+}
+
+// LoadState restores a snapshot written by SaveState. On failure the
+// machine is rolled back to the state it was in before the call.
+func (gba *GBA) LoadState(r io.Reader) error {
+	var backup bytes.Buffer
+	gba.saveState(state.NewWriter(&backup))
+
+	sr := state.NewReader(r)
+	magic := make([]byte, len(stateMagic))
+	var version uint32
+	sr.Read(magic)
+	sr.Read(&version)
+	if err := sr.Err(); err != nil {
+		return err
+	}
+	if string(magic) != stateMagic {
+		return ErrInvalidState
+	}
+	if version != stateVersion {
+		return fmt.Errorf("emulator: unsupported save state version %d", version)
+	}
+
+	gba.loadState(sr)
+	if err := sr.Err(); err != nil {
+		gba.loadState(state.NewReader(&backup))
+		return err
+	}
+	return nil
+}
+
+func (gba *GBA) saveState(w *state.Writer) {
+	gba.CPU.SaveState(w)
+	gba.CPU.IRQ.SaveState(w)
+	gba.Bus.SaveState(w)
+	gba.Bus.GamePak.SaveState(w)
+	gba.Bus.IOReg.SaveState(w)
+	gba.PPU.SaveState(w)
+	gba.APU.SaveState(w)
+	for ch := 0; ch < 4; ch++ {
+		gba.DMA[ch].SaveState(w)
+	}
+	for i := 0; i < 4; i++ {
+		gba.Timers[i].SaveState(w)
+	}
+	gba.Input.SaveState(w)
+	gba.Scheduler.SaveState(w)
+}
+
+func (gba *GBA) loadState(r *state.Reader) {
+	gba.CPU.LoadState(r)
+	gba.CPU.IRQ.LoadState(r)
+	gba.Bus.LoadState(r)
+	gba.Bus.GamePak.LoadState(r)
+	gba.Bus.IOReg.LoadState(r)
+	gba.Bus.UpdateWaitStates()
+	gba.PPU.LoadState(r)
+	gba.APU.LoadState(r)
+	for ch := 0; ch < 4; ch++ {
+		gba.DMA[ch].LoadState(r)
+	}
+	for i := 0; i < 4; i++ {
+		gba.Timers[i].LoadState(r)
 	}
+	gba.Input.LoadState(r)
+	gba.Scheduler.LoadState(r)
+	gba.frameEnd = gba.Scheduler.Now()
 }
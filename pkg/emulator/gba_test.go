@@ -0,0 +1,219 @@
+package emulator
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+// testProgram sets mode 3 and keeps writing a counter to successive VRAM
+// halfwords, so every frame looks different.
+var testProgram = []uint32{
+	0xE3A00301, // mov r0, #0x4000000
+	0xE3A01B01, // mov r1, #0x400
+	0xE3811003, // orr r1, r1, #3
+	0xE1C010B0, // strh r1, [r0]
+	0xE3A02406, // mov r2, #0x6000000
+	0xE2833001, // loop: add r3, r3, #1
+	0xE0C230B2, // strh r3, [r2], #2
+	0xEAFFFFFC, // b loop
+}
+
+// newTestGBA loads testProgram. The markers are library strings placed
+// after it, such as "SIIRTC_V" for a cartridge with the RTC.
+func newTestGBA(t *testing.T, markers ...string) *GBA {
+	t.Helper()
+	rom := make([]byte, 0x200)
+	for i, opcode := range testProgram {
+		binary.LittleEndian.PutUint32(rom[4*i:], opcode)
+	}
+	offset := 0x100
+	for _, marker := range markers {
+		offset += copy(rom[offset:], marker)
+	}
+	gba := NewGBA()
+	gba.UseHLEBIOS()
+	if err := gba.LoadROM(rom); err != nil {
+		t.Fatal(err)
+	}
+	gba.Start()
+	return gba
+}
+
+// readRTCDateTime reads the 7-byte date and time through the GPIO port the
+// way games do, which leaves the RTC idle at the end of a full transfer.
+func readRTCDateTime(gba *GBA) []byte {
+	const data, direction, control = 0x80000C4, 0x80000C6, 0x80000C8
+	gba.Bus.Write8(control, 1)
+	gba.Bus.Write8(direction, 7)
+	gba.Bus.Write8(data, 1) // CS low
+	gba.Bus.Write8(data, 5) // CS high
+	command := byte(0xA6)   // read date and time, sent LSB first
+	for i := 0; i < 8; i++ {
+		bit := (command >> i) & 1
+		gba.Bus.Write8(data, 4|bit<<1)
+		gba.Bus.Write8(data, 5|bit<<1)
+	}
+	gba.Bus.Write8(direction, 5)
+	result := make([]byte, 7)
+	for i := 0; i < 8*len(result); i++ {
+		gba.Bus.Write8(data, 4)
+		gba.Bus.Write8(data, 5)
+		result[i/8] |= (gba.Bus.Read8(data) >> 1 & 1) << (i % 8)
+	}
+	gba.Bus.Write8(data, 1)
+	return result
+}
+
+func runFrames(gba *GBA, n int) {
+	for i := 0; i < n; i++ {
+		gba.Update(nil)
+	}
+}
+
+type snapshot struct {
+	frame []byte
+	regs  [16]uint32
+	cpsr  uint32
+	now   uint64
+}
+
+func takeSnapshot(gba *GBA) snapshot {
+	s := snapshot{
+		frame: bytes.Clone(gba.PPU.GetFrameBuffer()),
+		cpsr:  gba.CPU.CPSR,
+		now:   gba.Scheduler.Now(),
+	}
+	for i := range s.regs {
+		s.regs[i] = gba.CPU.ReadReg(i)
+	}
+	return s
+}
+
+func compareSnapshots(t *testing.T, got snapshot, want snapshot) {
+	t.Helper()
+	if !bytes.Equal(got.frame, want.frame) {
+		t.Error("frame buffer differs")
+	}
+	if got.regs != want.regs {
+		t.Errorf("registers = %08X, want %08X", got.regs, want.regs)
+	}
+	if got.cpsr != want.cpsr {
+		t.Errorf("CPSR = %08X, want %08X", got.cpsr, want.cpsr)
+	}
+	if got.now != want.now {
+		t.Errorf("cycle = %d, want %d", got.now, want.now)
+	}
+}
+
+func TestStateRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		markers []string
+	}{
+		{"no RTC", nil},
+		{"RTC after a clock read", []string{"SIIRTC_V"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gba := newTestGBA(t, tt.markers...)
+			rtc := gba.Bus.GamePak.RTC
+			if (rtc != nil) != (tt.markers != nil) {
+				t.Fatalf("RTC = %v", rtc)
+			}
+			runFrames(gba, 10)
+			if rtc != nil {
+				if date := readRTCDateTime(gba); date[1] == 0 {
+					t.Fatalf("RTC date = % X", date)
+				}
+			}
+			var saved bytes.Buffer
+			if err := gba.SaveState(&saved); err != nil {
+				t.Fatal(err)
+			}
+			runFrames(gba, 5)
+			want := takeSnapshot(gba)
+
+			runFrames(gba, 7)
+			if err := gba.LoadState(bytes.NewReader(saved.Bytes())); err != nil {
+				t.Fatal(err)
+			}
+			runFrames(gba, 5)
+			compareSnapshots(t, takeSnapshot(gba), want)
+			if rtc != nil {
+				if date := readRTCDateTime(gba); date[1] == 0 {
+					t.Errorf("RTC date after load = % X", date)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadStateRollback(t *testing.T) {
+	source := newTestGBA(t)
+	runFrames(source, 3)
+	var good bytes.Buffer
+	if err := source.SaveState(&good); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		data    func() []byte
+		wantErr error // nil: any error
+	}{
+		{
+			name: "truncated",
+			data: func() []byte { return good.Bytes()[:good.Len()/2] },
+		},
+		{
+			name: "truncated header",
+			data: func() []byte { return good.Bytes()[:6] },
+		},
+		{
+			name: "wrong version",
+			data: func() []byte {
+				data := bytes.Clone(good.Bytes())
+				binary.LittleEndian.PutUint32(data[len(stateMagic):], stateVersion+1)
+				return data
+			},
+		},
+		{
+			name: "wrong magic",
+			data: func() []byte {
+				data := bytes.Clone(good.Bytes())
+				copy(data, "XXXX")
+				return data
+			},
+			wantErr: ErrInvalidState,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gba := newTestGBA(t)
+			runFrames(gba, 8)
+			var before bytes.Buffer
+			if err := gba.SaveState(&before); err != nil {
+				t.Fatal(err)
+			}
+			want := takeSnapshot(gba)
+
+			err := gba.LoadState(bytes.NewReader(tt.data()))
+			if err == nil {
+				t.Fatal("LoadState succeeded")
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("error = %v, want %v", err, tt.wantErr)
+			}
+			var after bytes.Buffer
+			if err := gba.SaveState(&after); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(after.Bytes(), before.Bytes()) {
+				t.Error("machine state changed after a failed load")
+			}
+			compareSnapshots(t, takeSnapshot(gba), want)
+		})
+	}
+}